@@ -0,0 +1,362 @@
+package s3router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBodyStalled fails a target of a teed body that stopped reading it for
+// longer than the stall timeout set with WithTeeBuffer.
+var ErrBodyStalled = errors.New("endpoint stopped reading the request body")
+
+// WithTeeBuffer sets how far apart the targets of a teed body may drift:
+// each gets a buffer of size bytes, and one whose buffer stays full for
+// stall is failed with ErrBodyStalled so the others can go on. A stall of
+// 0 waits forever. Defaults to 1 MiB and one minute; a size of 0 keeps the
+// default.
+func WithTeeBuffer(size int, stall time.Duration) Option {
+	return func(c *router) {
+		if size > 0 {
+			c.tee.size = size
+		}
+		c.tee.stall = stall
+	}
+}
+
+type teeConfig struct {
+	size  int
+	stall time.Duration
+}
+
+var defaultTee = teeConfig{size: 1 << 20, stall: time.Minute}
+
+// teeBody returns n readers over r, fed by a goroutine through a bounded
+// buffer each. Cancelling ctx fails all of them.
+func teeBody(ctx context.Context, r io.Reader, n int, cfg teeConfig) ([]io.Reader, error) {
+	sides := make([]*teeSide, n)
+	readers := make([]io.Reader, n)
+	for i := range sides {
+		sides[i] = newTeeSide(cfg.size)
+		readers[i] = sides[i]
+	}
+	go func() {
+		buf := make([]byte, min(cfg.size, 32<<10))
+		live := sides
+		for len(live) > 0 {
+			if err := ctx.Err(); err != nil {
+				for _, s := range live {
+					s.fail(err)
+				}
+				return
+			}
+			m, rerr := r.Read(buf)
+			if m > 0 {
+				next := live[:0]
+				for _, s := range live {
+					if err := s.write(ctx, buf[:m], cfg.stall); err != nil {
+						s.fail(err)
+					} else {
+						next = append(next, s)
+					}
+				}
+				live = next
+			}
+			if rerr != nil {
+				for _, s := range live {
+					s.fail(rerr)
+				}
+				return
+			}
+		}
+	}()
+	return readers, nil
+}
+
+// teeSide is one target's ring buffer of a teed body.
+type teeSide struct {
+	mu       sync.Mutex
+	buf      []byte
+	off, n   int   // start and length of the buffered data
+	err      error // once set, no more data arrives; io.EOF after a full copy
+	released bool
+
+	readable chan struct{} // signalled when data or err arrives
+	writable chan struct{} // signalled when space frees up or on release
+}
+
+func newTeeSide(size int) *teeSide {
+	return &teeSide{
+		buf:      make([]byte, size),
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// write copies p into the buffer, waiting for the reader to make room. It
+// fails if the reader makes none for stall, was released, or ctx ends.
+func (s *teeSide) write(ctx context.Context, p []byte, stall time.Duration) error {
+	var timeout <-chan time.Time
+	for len(p) > 0 {
+		s.mu.Lock()
+		if s.released {
+			s.mu.Unlock()
+			return errBodyNotCopied
+		}
+		w := 0
+		for w < len(p) && s.n < len(s.buf) {
+			end := (s.off + s.n) % len(s.buf)
+			c := copy(s.buf[end:min(len(s.buf), end+len(s.buf)-s.n)], p[w:])
+			s.n += c
+			w += c
+		}
+		s.mu.Unlock()
+		if w > 0 {
+			p = p[w:]
+			signal(s.readable)
+			timeout = nil
+			continue
+		}
+		if timeout == nil && stall > 0 {
+			timeout = time.After(stall)
+		}
+		select {
+		case <-s.writable:
+		case <-timeout:
+			return fmt.Errorf("%w for %s", ErrBodyStalled, stall)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *teeSide) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	signal(s.readable)
+}
+
+func (s *teeSide) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.n > 0 {
+			c := copy(p, s.buf[s.off:min(len(s.buf), s.off+s.n)])
+			s.off = (s.off + c) % len(s.buf)
+			s.n -= c
+			s.mu.Unlock()
+			signal(s.writable)
+			return c, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		<-s.readable
+	}
+}
+
+// release lets the tee go on without a target that is done reading.
+func (s *teeSide) release() {
+	s.mu.Lock()
+	s.released = true
+	s.mu.Unlock()
+	signal(s.writable)
+}
+
+// leadTee is the first target's reader for a best-effort body too large to
+// buffer whole. Whatever the first target reads is copied to a sideBuffer
+// for each other target without ever waiting for them.
+type leadTee struct {
+	r     io.Reader
+	sides []*sideBuffer
+}
+
+// bestEffortTee returns n readers over body. The first reads body itself;
+// the others lag behind it by at most limit bytes each, counted against the
+// buffer budget, and are cut off with errBodyNotCopied if they fall further
+// behind or the budget runs out.
+func (c *router) bestEffortTee(body io.Reader, n int, limit int64) []io.Reader {
+	lead := &leadTee{r: body, sides: make([]*sideBuffer, n-1)}
+	readers := make([]io.Reader, n)
+	readers[0] = lead
+	for i := range lead.sides {
+		lead.sides[i] = newSideBuffer(c, limit)
+		readers[i+1] = lead.sides[i]
+	}
+	return readers
+}
+
+func (t *leadTee) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	for _, s := range t.sides {
+		s.write(p[:n])
+		if err != nil {
+			s.finish(err)
+		}
+	}
+	return n, err
+}
+
+// release cuts off the other targets if the first stopped reading early.
+func (t *leadTee) release() {
+	for _, s := range t.sides {
+		s.finish(errBodyNotCopied)
+	}
+}
+
+// sideBuffer is a bounded buffer between a leadTee and one other target.
+type sideBuffer struct {
+	c     *router // accounts for the buffered bytes
+	mu    sync.Mutex
+	cond  sync.Cond
+	buf   bytes.Buffer
+	limit int64
+	err   error // once set, no more data arrives; io.EOF after a full copy
+}
+
+func newSideBuffer(c *router, limit int64) *sideBuffer {
+	s := &sideBuffer{c: c, limit: limit}
+	s.cond.L = &s.mu
+	return s
+}
+
+func (s *sideBuffer) write(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if int64(s.buf.Len()+len(p)) > s.limit || !s.c.tryHold(int64(len(p))) {
+		s.err = errBodyNotCopied
+		s.drop()
+	} else {
+		s.buf.Write(p)
+	}
+	s.cond.Broadcast()
+}
+
+// drop frees the buffered bytes. s.mu must be held.
+func (s *sideBuffer) drop() {
+	s.c.unhold(int64(s.buf.Len()))
+	s.buf = bytes.Buffer{}
+}
+
+func (s *sideBuffer) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+func (s *sideBuffer) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf.Len() == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() > 0 {
+		n, err := s.buf.Read(p)
+		s.c.unhold(int64(n))
+		return n, err
+	}
+	return 0, s.err
+}
+
+// release stops buffering for a target that is done reading.
+func (s *sideBuffer) release() {
+	s.finish(errBodyNotCopied)
+	s.mu.Lock()
+	s.drop()
+	s.mu.Unlock()
+}
+
+// ErrBodyNotReplayable is returned by a fallback write when an endpoint
+// failed after reading part of a body that could be neither rewound nor
+// buffered, so the next endpoint would only get the rest of it.
+var ErrBodyNotReplayable = errors.New("request body was partly consumed and cannot be replayed")
+
+// fallbackBodies returns n readers over body, one per fallback attempt,
+// each starting from the beginning. Seekable bodies are rewound; others are
+// buffered like mirrored ones when they fit, and otherwise sent as-is, in
+// which case only an endpoint that failed before reading any of the body
+// can be fallen back from.
+func (c *router) fallbackBodies(ctx context.Context, body io.Reader, size *int64, n int) ([]io.Reader, error) {
+	if s, ok := body.(io.ReadSeeker); ok {
+		if off, err := s.Seek(0, io.SeekCurrent); err == nil {
+			return repeatBody(&rewinder{ReadSeeker: s, off: off}, n), nil
+		}
+	}
+	if c.spool != nil {
+		return c.spool.split(ctx, body, size, n, func(r io.Reader) ([]io.Reader, error) {
+			return repeatBody(&oneShot{r: r}, n), nil
+		})
+	}
+	if size != nil && *size < c.maxBufferBytes {
+		if readers, err := c.bufferBody(ctx, body, *size, n); readers != nil || err != nil {
+			return readers, err
+		}
+	}
+	return repeatBody(&oneShot{r: body}, n), nil
+}
+
+func repeatBody(r io.Reader, n int) []io.Reader {
+	readers := make([]io.Reader, n)
+	for i := range readers {
+		readers[i] = r
+	}
+	return readers
+}
+
+// rewinder is a seekable body shared by every fallback attempt.
+type rewinder struct {
+	io.ReadSeeker
+	off int64 // where the caller left the body
+}
+
+func (r *rewinder) rewind() error {
+	_, err := r.Seek(r.off, io.SeekStart)
+	return err
+}
+
+// oneShot is a body that can be sent once, or again if nothing read it.
+type oneShot struct {
+	r    io.Reader
+	read atomic.Bool
+}
+
+func (o *oneShot) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	if n > 0 {
+		o.read.Store(true)
+	}
+	return n, err
+}
+
+func (o *oneShot) rewind() error {
+	if o.read.Load() {
+		return ErrBodyNotReplayable
+	}
+	return nil
+}
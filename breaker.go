@@ -0,0 +1,220 @@
+package s3router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/store"
+)
+
+// BreakerState is the state of an endpoint's circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // requests flow
+	BreakerOpen                         // requests fail fast until the cool-down ends
+	BreakerHalfOpen                     // one probe request decides whether to close
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// ErrCircuitOpen is returned, wrapped in an EndpointError, for requests not
+// sent to an endpoint because its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig configures the per-endpoint circuit breakers. Zero fields
+// take their defaults.
+type BreakerConfig struct {
+	Window      int           // recent requests the error rate is taken over (default 20)
+	MinRequests int           // requests in the window before it can trip (default 10)
+	ErrorRate   float64       // failed fraction of the window that opens it (default 0.5)
+	Cooldown    time.Duration // time open before a probe is let through (default 30s)
+
+	// OnStateChange, if set, is called after an endpoint's breaker changes
+	// state. It must not block.
+	OnStateChange func(ep config.Endpoint, from, to BreakerState)
+}
+
+// WithCircuitBreaker tracks the health of every endpoint. An endpoint whose
+// recent requests fail too often is skipped, so fallback moves on without
+// waiting for it, and is probed again after a cool-down.
+func WithCircuitBreaker(bc BreakerConfig) Option {
+	return func(c *router) {
+		if bc.Window <= 0 {
+			bc.Window = 20
+		}
+		if bc.MinRequests <= 0 {
+			bc.MinRequests = 10
+		}
+		bc.MinRequests = min(bc.MinRequests, bc.Window)
+		if bc.ErrorRate <= 0 {
+			bc.ErrorRate = 0.5
+		}
+		if bc.Cooldown <= 0 {
+			bc.Cooldown = 30 * time.Second
+		}
+		c.breakers = make(map[config.Endpoint]*breaker, len(c.cfg.EndpointOrder))
+		for _, ep := range c.cfg.EndpointOrder {
+			c.breakers[ep] = &breaker{ep: ep, cfg: bc, window: make([]bool, bc.Window)}
+		}
+	}
+}
+
+func (c *router) BreakerStates() map[config.Endpoint]BreakerState {
+	states := make(map[config.Endpoint]BreakerState, len(c.cfg.EndpointOrder))
+	for _, ep := range c.cfg.EndpointOrder {
+		states[ep] = c.breakers[ep].State()
+	}
+	return states
+}
+
+// breaker is one endpoint's circuit breaker. A nil breaker is always closed.
+type breaker struct {
+	ep  config.Endpoint
+	cfg BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	window   []bool // ring of recent outcomes, true for a failure
+	next     int    // next slot in window
+	count    int    // outcomes in window
+	failures int    // failures in window
+	openedAt time.Time
+	probing  bool // a half-open probe is in flight
+}
+
+func (b *breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cfg.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a request may be sent, and whether it is the
+// probe that decides a half-open breaker. Once the cool-down is over, a
+// single probe is let through at a time.
+func (b *breaker) allow() (ok, probe bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	from := b.state
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cfg.Cooldown {
+			b.mu.Unlock()
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			b.mu.Unlock()
+			return false, false
+		}
+	default:
+		b.mu.Unlock()
+		return true, false
+	}
+	b.probing = true
+	b.mu.Unlock()
+	b.changed(from, BreakerHalfOpen)
+	return true, true
+}
+
+// record counts the outcome of a request that allow let through. Only the
+// probe decides a half-open breaker; requests let through while it was
+// closed that return after it opened are not counted.
+func (b *breaker) record(probe, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case probe && b.state == BreakerHalfOpen:
+		b.probing = false
+		b.reset()
+		if failed {
+			b.state, b.openedAt = BreakerOpen, time.Now()
+		} else {
+			b.state = BreakerClosed
+		}
+	case !probe && b.state == BreakerClosed:
+		if b.count == len(b.window) {
+			if b.window[b.next] {
+				b.failures--
+			}
+		} else {
+			b.count++
+		}
+		b.window[b.next] = failed
+		b.next = (b.next + 1) % len(b.window)
+		if failed {
+			b.failures++
+		}
+		if b.count >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.ErrorRate*float64(b.count) {
+			b.reset()
+			b.state, b.openedAt = BreakerOpen, time.Now()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+}
+
+func (b *breaker) reset() {
+	clear(b.window)
+	b.next, b.count, b.failures = 0, 0, 0
+}
+
+func (b *breaker) changed(from, to BreakerState) {
+	if from != to && b.cfg.OnStateChange != nil {
+		b.cfg.OnStateChange(b.ep, from, to)
+	}
+}
+
+// guarded sends op through each target's breaker: targets whose breaker is
+// open fail fast, and the outcome of every request sent is recorded. Only
+// network errors, timeouts, server errors and throttling count against an
+// endpoint; errors the caller caused, such as a failed precondition or a
+// missing object, and its own cancellation say nothing about its health.
+func guarded[T any](op func(context.Context, target) (T, error)) func(context.Context, target) (T, error) {
+	return func(ctx context.Context, t target) (T, error) {
+		ok, probe := t.br.allow()
+		if !ok {
+			var zero T
+			return zero, EndpointError{Endpoint: t.name, Err: ErrCircuitOpen}
+		}
+		out, err := op(ctx, t)
+		t.br.record(probe, err != nil && ctx.Err() == nil && unhealthy(err))
+		return out, err
+	}
+}
+
+// unhealthy reports whether err means the endpoint itself is failing.
+func unhealthy(err error) bool {
+	switch store.Classify(err) {
+	case config.ErrNetwork, config.ErrTimeout, config.ErrServer, config.ErrThrottling:
+		return true
+	}
+	return false
+}
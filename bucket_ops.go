@@ -0,0 +1,69 @@
+package s3router
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+)
+
+// ListBuckets lists the logical buckets of the configuration. No endpoint
+// is asked.
+func (c *router) ListBuckets(ctx context.Context, in *s3.ListBucketsInput, optFns ...func(*s3.Options)) (*s3.ListBucketsOutput, error) {
+	names := make([]string, 0, len(c.cfg.Buckets))
+	for name := range c.cfg.Buckets {
+		if strings.HasPrefix(name, aws.ToString(in.Prefix)) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	out := &s3.ListBucketsOutput{Prefix: in.Prefix, Buckets: make([]types.Bucket, len(names))}
+	for i, name := range names {
+		out.Buckets[i] = types.Bucket{Name: aws.String(name)}
+	}
+	return out, nil
+}
+
+// HeadBucket checks the physical buckets as the rules for the bucket's
+// root route the request: a mirrored bucket must exist everywhere, a
+// fallback one on some endpoint.
+func (c *router) HeadBucket(ctx context.Context, in *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	const op = "HeadBucket"
+	rt, err := c.route(op, aws.ToString(in.Bucket), "")
+	if err != nil {
+		return nil, err
+	}
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.HeadBucketOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.HeadBucket(ctx, &in, optFns...)
+		},
+	)
+}
+
+// CreateBucket creates the physical buckets on every endpoint that some
+// rule for the bucket routes requests to, and fails if any of them fails.
+func (c *router) CreateBucket(ctx context.Context, in *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	const op = "CreateBucket"
+	bucket := aws.ToString(in.Bucket)
+	if !c.cfg.IsLogicalBucket(bucket) {
+		return nil, fmt.Errorf("%s: bucket %q is not configured", op, bucket)
+	}
+	rt := route{action: config.ActMirror}
+	for i, ep := range c.cfg.BucketEndpoints(bucket) {
+		rt.targets = append(rt.targets, c.target(i, ep, bucket))
+	}
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.CreateBucketOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.CreateBucket(ctx, &in, optFns...)
+		},
+	)
+}
@@ -0,0 +1,59 @@
+package s3router
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestBucketOps(t *testing.T) {
+	ctx := context.Background()
+	cfg := mustLoad(t, `
+buckets:
+  photos:
+    primary: photos
+    secondary: cf-photos
+  logs: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": mirror
+  - bucket: logs
+    prefix:
+      "*":
+        "*": primary
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	r, _ := New(cfg, p, s)
+
+	list, err := r.ListBuckets(ctx, &s3.ListBucketsInput{})
+	if err != nil {
+		t.Fatalf("ListBuckets: %v", err)
+	}
+	var names []string
+	for _, b := range list.Buckets {
+		names = append(names, aws.ToString(b.Name))
+	}
+	if got := fmt.Sprint(names); got != "[logs photos]" {
+		t.Fatalf("ListBuckets = %s", got)
+	}
+
+	if _, err := r.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String("photos")}); err == nil {
+		t.Fatalf("HeadBucket before CreateBucket succeeded")
+	}
+	for _, b := range []string{"photos", "logs"} {
+		if _, err := r.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(b)}); err != nil {
+			t.Fatalf("CreateBucket(%s): %v", b, err)
+		}
+		if _, err := r.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(b)}); err != nil {
+			t.Fatalf("HeadBucket(%s): %v", b, err)
+		}
+	}
+	if got := fmt.Sprint(p.buckets, s.buckets); got != "map[logs:true photos:true] map[cf-photos:true]" {
+		t.Fatalf("physical buckets = %s", got)
+	}
+}
@@ -0,0 +1,178 @@
+package s3router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// BudgetPolicy is what a request does when its body does not fit in the
+// buffer budget.
+type BudgetPolicy int
+
+const (
+	BudgetWait   BudgetPolicy = iota // wait for other requests to free memory
+	BudgetStream                     // stream the body instead of buffering it
+	BudgetReject                     // fail with ErrBufferBudget
+)
+
+// ErrBufferBudget is returned under BudgetReject when a body cannot be
+// buffered within the budget.
+var ErrBufferBudget = errors.New("request body does not fit in the buffer budget")
+
+// WithBufferBudget caps the memory all requests together hold in copies of
+// request bodies at n bytes. That covers bodies buffered below
+// WithMaxBufferBytes, the in-memory part of bodies handled by
+// WithSpillToDisk, and what best-effort targets lag behind the first one.
+// A buffered body that does not fit is handled according to policy; one
+// larger than n never fits, and under BudgetWait is streamed. A spilled body
+// that does not fit goes to disk instead unless the policy is BudgetWait,
+// and a best-effort target that would exceed the budget is cut off and left
+// to the replication queue. Tee buffers set with WithTeeBuffer are a fixed
+// size per target and are not counted.
+func WithBufferBudget(n int64, policy BudgetPolicy) Option {
+	return func(c *router) {
+		c.budget = &byteBudget{limit: n, policy: policy, freed: make(chan struct{})}
+	}
+}
+
+func (c *router) BufferedBytes() int64 { return c.buffered.Load() }
+
+// byteBudget is a weighted semaphore over bytes.
+type byteBudget struct {
+	limit  int64
+	policy BudgetPolicy
+
+	mu    sync.Mutex
+	used  int64
+	freed chan struct{} // closed and replaced on every release
+}
+
+// acquire reserves n bytes. It returns false if the body should be
+// streamed instead.
+func (b *byteBudget) acquire(ctx context.Context, n int64) (bool, error) {
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return true, nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+		switch {
+		case b.policy == BudgetReject:
+			return false, ErrBufferBudget
+		case b.policy == BudgetStream, n > b.limit:
+			return false, nil
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// tryAcquire reserves n bytes if they are free right away.
+func (b *byteBudget) tryAcquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// hold counts n more bytes of request bodies kept in memory, waiting for
+// the budget as its policy says. It returns false if the body should not be
+// kept in memory.
+func (c *router) hold(ctx context.Context, n int64) (bool, error) {
+	if c.budget != nil {
+		if ok, err := c.budget.acquire(ctx, n); !ok {
+			return false, err
+		}
+	}
+	c.buffered.Add(n)
+	return true, nil
+}
+
+// tryHold is hold for readers that must never wait.
+func (c *router) tryHold(n int64) bool {
+	if c.budget != nil && !c.budget.tryAcquire(n) {
+		return false
+	}
+	c.buffered.Add(n)
+	return true
+}
+
+// unhold gives back n bytes counted by hold or tryHold.
+func (c *router) unhold(n int64) {
+	if n == 0 {
+		return
+	}
+	c.buffered.Add(-n)
+	if c.budget != nil {
+		c.budget.release(n)
+	}
+}
+
+// bufferBody reads a body of the given size into memory and returns n
+// readers over it, or nil if the budget says to stream it instead. The
+// memory counts against the budget until every reader is released.
+func (c *router) bufferBody(ctx context.Context, body io.Reader, size int64, n int) ([]io.Reader, error) {
+	if ok, err := c.hold(ctx, size); !ok {
+		return nil, err
+	}
+	readers, err := drainBody(ctx, body, n)
+	if err != nil {
+		c.unhold(size)
+		return nil, err
+	}
+	return c.held(readers, size), nil
+}
+
+// held wraps readers over one body of size bytes, counted by hold, so the
+// memory is given back once every one of them is released.
+func (c *router) held(readers []io.Reader, size int64) []io.Reader {
+	h := &bufferHold{c: c, size: size}
+	h.refs.Store(int32(len(readers)))
+	for i, r := range readers {
+		readers[i] = &heldReader{Reader: r.(*bytes.Reader), hold: h}
+	}
+	return readers
+}
+
+// bufferHold is a buffered body shared by the readers of every target.
+type bufferHold struct {
+	c    *router
+	size int64
+	refs atomic.Int32
+}
+
+func (h *bufferHold) release() {
+	if h.refs.Add(-1) == 0 {
+		h.c.unhold(h.size)
+	}
+}
+
+// heldReader is one target's view of a buffered body.
+type heldReader struct {
+	*bytes.Reader
+	hold *bufferHold
+	once sync.Once
+}
+
+func (r *heldReader) release() { r.once.Do(r.hold.release) }
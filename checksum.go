@@ -0,0 +1,175 @@
+package s3router
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+)
+
+// WithChecksumMismatch sets a function called with every mirrored write
+// whose copies disagree, on rules with verify set to either mode.
+func WithChecksumMismatch(fn func(context.Context, *ChecksumError)) Option {
+	return func(c *router) {
+		c.onMismatch = fn
+	}
+}
+
+// ChecksumError reports a mirrored write whose endpoints did not all store
+// the bytes the router sent them. Want is the checksum the router computed
+// while sending the body, if it could; Got is what each endpoint returned.
+// Algorithm is "" when the endpoints returned no checksum and only their
+// ETags were compared.
+type ChecksumError struct {
+	Bucket    string
+	Key       string
+	Algorithm types.ChecksumAlgorithm
+	Want      string
+	Got       map[config.Endpoint]string
+}
+
+func (e *ChecksumError) Error() string {
+	kind := "ETag"
+	if e.Algorithm != "" {
+		kind = string(e.Algorithm) + " checksum"
+	}
+	got := make([]string, 0, len(e.Got))
+	for ep, sum := range e.Got {
+		got = append(got, fmt.Sprintf("%s=%s", ep, sum))
+	}
+	slices.Sort(got)
+	msg := fmt.Sprintf("mirrored copies of %s/%s differ: %s %s", e.Bucket, e.Key, kind, strings.Join(got, ", "))
+	if e.Want != "" {
+		msg += ", want " + e.Want
+	}
+	return msg
+}
+
+// mirrorCheck verifies that the targets of a mirrored write all stored the
+// body the router sent them.
+type mirrorCheck struct {
+	algo  types.ChecksumAlgorithm
+	h     hash.Hash // of the request body; nil if the router cannot compute algo
+	sums  []string  // checksum each target returned
+	etags []string
+}
+
+// checkMirror returns a check for a mirrored write of rt, or nil if the
+// rule does not ask for one. The write asks endpoints for algo, CRC32C if
+// the caller chose none.
+func checkMirror(rt route, algo types.ChecksumAlgorithm) *mirrorCheck {
+	if rt.verify == "" || rt.action != config.ActMirror {
+		return nil
+	}
+	if algo == "" {
+		algo = types.ChecksumAlgorithmCrc32c
+	}
+	m := &mirrorCheck{algo: algo, sums: make([]string, len(rt.targets)), etags: make([]string, len(rt.targets))}
+	switch algo {
+	case types.ChecksumAlgorithmCrc32:
+		m.h = crc32.NewIEEE()
+	case types.ChecksumAlgorithmCrc32c:
+		m.h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case types.ChecksumAlgorithmSha1:
+		m.h = sha1.New()
+	case types.ChecksumAlgorithmSha256:
+		m.h = sha256.New()
+	}
+	return m
+}
+
+// body hashes the request body as the targets read it.
+func (m *mirrorCheck) body(r io.Reader) io.Reader {
+	if m.h == nil || r == nil {
+		return r
+	}
+	return io.TeeReader(r, m.h)
+}
+
+// record notes what target i returned for a successful write.
+func (m *mirrorCheck) record(i int, etag, sumCRC32, sumCRC32C, sumSHA1, sumSHA256 *string) {
+	m.etags[i] = aws.ToString(etag)
+	switch m.algo {
+	case types.ChecksumAlgorithmCrc32:
+		m.sums[i] = aws.ToString(sumCRC32)
+	case types.ChecksumAlgorithmCrc32c:
+		m.sums[i] = aws.ToString(sumCRC32C)
+	case types.ChecksumAlgorithmSha1:
+		m.sums[i] = aws.ToString(sumSHA1)
+	case types.ChecksumAlgorithmSha256:
+		m.sums[i] = aws.ToString(sumSHA256)
+	}
+}
+
+// md5ETag matches the ETag of an object uploaded in one part without
+// SSE-KMS, which is the MD5 of its body on every S3 implementation.
+var md5ETag = regexp.MustCompile(`^"?[0-9a-fA-F]{32}"?$`)
+
+// mismatch compares what the targets returned after every one of them
+// succeeded. Checksums are compared with each other and with the one the
+// router computed; endpoints that return none are skipped. If none of them
+// do, plain MD5 ETags are compared instead.
+func (m *mirrorCheck) mismatch(rt route, bucket, key string) *ChecksumError {
+	want := ""
+	if m.h != nil {
+		want = base64.StdEncoding.EncodeToString(m.h.Sum(nil))
+	}
+	e := &ChecksumError{Bucket: bucket, Key: key, Algorithm: m.algo, Want: want, Got: make(map[config.Endpoint]string)}
+	bad := false
+	for i, sum := range m.sums {
+		if sum == "" {
+			continue
+		}
+		if want == "" {
+			want = sum // compare the others with the first one reported
+		}
+		bad = bad || sum != want
+		e.Got[rt.targets[i].name] = sum
+	}
+	if len(e.Got) > 0 {
+		if bad {
+			return e
+		}
+		return nil
+	}
+
+	e = &ChecksumError{Bucket: bucket, Key: key, Got: make(map[config.Endpoint]string)}
+	for i, etag := range m.etags {
+		if !md5ETag.MatchString(etag) {
+			return nil
+		}
+		bad = bad || !strings.EqualFold(strings.Trim(etag, `"`), strings.Trim(m.etags[0], `"`))
+		e.Got[rt.targets[i].name] = etag
+	}
+	if bad {
+		return e
+	}
+	return nil
+}
+
+// verify reports a mirrored write whose copies disagree, and fails it if
+// the rule says so.
+func (c *router) verify(ctx context.Context, rt route, m *mirrorCheck, bucket, key string) error {
+	e := m.mismatch(rt, bucket, key)
+	if e == nil {
+		return nil
+	}
+	if c.onMismatch != nil {
+		c.onMismatch(ctx, e)
+	}
+	if rt.verify == config.VerifyFail {
+		return e
+	}
+	return nil
+}
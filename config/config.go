@@ -3,24 +3,89 @@ package config
 import (
 	"fmt"
 	"io"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type yamlRule struct {
-	Bucket string                       `yaml:"bucket"`
-	Prefix map[string]map[string]string `yaml:"prefix"` // prefix → op → action
+	Bucket string                           `yaml:"bucket"`
+	Prefix map[string]map[string]yamlAction `yaml:"prefix"` // prefix → op → action
 }
 
-type BucketMapping struct {
-	Primary   string `yaml:"primary"`
-	Secondary string `yaml:"secondary"`
+// yamlAction is either a bare action ("mirror") or an action applied to an
+// explicit, ordered list of endpoints ({fallback: [s3, r2, minio]}). The
+// mapping form also carries the action's parameters, e.g. {quorum: , acks: 2}.
+type yamlAction struct {
+	Action   string
+	Targets  []string
+	Acks     int
+	Prefer   string
+	Failover []string
+	Delay    string
+	Verify   string
+	Repair   string
 }
 
+func (a *yamlAction) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		a.Action = n.Value
+		return nil
+	}
+	var m map[string]yaml.Node
+	if err := n.Decode(&m); err != nil {
+		return err
+	}
+	if acks, ok := m["acks"]; ok {
+		if err := acks.Decode(&a.Acks); err != nil {
+			return err
+		}
+		delete(m, "acks")
+	}
+	if prefer, ok := m["prefer"]; ok {
+		a.Prefer = prefer.Value
+		delete(m, "prefer")
+	}
+	if delay, ok := m["delay"]; ok {
+		a.Delay = delay.Value
+		delete(m, "delay")
+	}
+	if repair, ok := m["repair"]; ok {
+		a.Repair = repair.Value
+		delete(m, "repair")
+	}
+	if verify, ok := m["verify"]; ok {
+		a.Verify = verify.Value
+		delete(m, "verify")
+	}
+	if failover, ok := m["failover"]; ok {
+		if err := failover.Decode(&a.Failover); err != nil {
+			return err
+		}
+		delete(m, "failover")
+	}
+	if len(m) != 1 {
+		return fmt.Errorf("line %d: expected a single action, got %d", n.Line, len(m))
+	}
+	for act, targets := range m {
+		a.Action = act
+		// a null value ("quorum:") keeps every endpoint
+		if err := targets.Decode(&a.Targets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BucketMapping maps an endpoint name to the physical bucket on it.
+type BucketMapping map[Endpoint]string
+
 type yamlConfig struct {
-	Endpoints map[string]string        `yaml:"endpoints"`
+	Endpoints yaml.Node                `yaml:"endpoints"` // node keeps document order
 	Buckets   map[string]BucketMapping `yaml:"buckets"`
 	Rules     []yamlRule               `yaml:"rules"`
 }
@@ -36,23 +101,117 @@ const (
 	ActFallback   Action = "fallback"
 	ActMirror     Action = "mirror"
 	ActBestEffort Action = "best-effort"
+	ActQuorum     Action = "quorum"
+	// ActMigrateOnRead reads like fallback, and copies objects that were
+	// missing on the first endpoint into it from the one that served them.
+	ActMigrateOnRead Action = "migrate-on-read"
+	// ActMerge lists every endpoint and merges the results by key; other
+	// operations behave like fallback.
+	ActMerge Action = "merge"
+	// ActHedge reads from the first endpoint and, if it has not answered
+	// within a delay, also from the next; the first answer wins. Only
+	// GetObject and HeadObject may be hedged.
+	ActHedge Action = "hedge"
 
 	EndpointPrimary   Endpoint = "primary"
 	EndpointSecondary Endpoint = "secondary"
 )
 
+// HedgeDelay is how long a hedged read waits for one endpoint before also
+// asking the next: a fixed Duration, or else the given Percentile of that
+// endpoint's recent latencies.
+type HedgeDelay struct {
+	Duration   time.Duration
+	Percentile float64 // in (0, 100)
+}
+
+// DefaultHedgeDelay is used by hedge rules without a delay.
+var DefaultHedgeDelay = HedgeDelay{Percentile: 95}
+
+// parseHedgeDelay parses a duration ("50ms") or a percentile ("p95").
+func parseHedgeDelay(s string) (HedgeDelay, error) {
+	if p, ok := strings.CutPrefix(s, "p"); ok {
+		pct, err := strconv.ParseFloat(p, 64)
+		if err != nil || pct <= 0 || pct >= 100 {
+			return HedgeDelay{}, fmt.Errorf("invalid delay percentile %q", s)
+		}
+		return HedgeDelay{Percentile: pct}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return HedgeDelay{}, fmt.Errorf("invalid delay %q", s)
+	}
+	return HedgeDelay{Duration: d}, nil
+}
+
+// Verify is what a mirrored write does when the checksums of its copies
+// disagree.
+type Verify string
+
+const (
+	VerifyFail Verify = "fail" // return a *ChecksumError to the caller
+	VerifyFlag Verify = "flag" // report the mismatch, but let the write succeed
+)
+
+// Repair is what a fallback read does when the first endpoint lacks an
+// object that a later one serves.
+type Repair string
+
+const (
+	RepairCopy   Repair = "copy"   // copy the object back to the first endpoint
+	RepairReport Repair = "report" // only report the divergence
+)
+
+// ErrorClass is a kind of error an endpoint can return. A rule's failover
+// list names the classes that make fallback move on to the next endpoint.
+type ErrorClass string
+
+const (
+	ErrNetwork    ErrorClass = "network"    // connection failures and other non-HTTP errors
+	ErrServer     ErrorClass = "5xx"        // server errors
+	ErrThrottling ErrorClass = "throttling" // SlowDown, 429 and the like
+	ErrNotFound   ErrorClass = "not-found"  // NoSuchKey, 404
+	ErrTimeout    ErrorClass = "timeout"    // deadlines and network timeouts
+	ErrClient     ErrorClass = "4xx"        // other client errors, e.g. 403
+	ErrCanceled   ErrorClass = "canceled"   // the caller's own cancellation; never fails over
+)
+
+// DefaultFailover is used by rules without a failover list: everything but
+// the caller's cancellation.
+var DefaultFailover = []ErrorClass{ErrNetwork, ErrServer, ErrThrottling, ErrNotFound, ErrTimeout, ErrClient}
+
 // Rule defines a routing rule for a specific bucket/prefix combination.
 type Rule struct {
-	Bucket  string            `yaml:"bucket"`  // logical bucket name
-	Prefix  string            `yaml:"prefix"`  // Prefix within the bucket ("" means root)
-	Actions map[string]Action `yaml:"actions"` // op -> action (must contain "*")
+	Bucket   string                  `yaml:"bucket"`             // logical bucket name
+	Prefix   string                  `yaml:"prefix"`             // Prefix within the bucket ("" means root)
+	Actions  map[string]Action       `yaml:"actions"`            // op -> action (must contain "*")
+	Targets  map[string][]Endpoint   `yaml:"targets,omitempty"`  // op -> endpoints, when not all of them
+	Acks     map[string]int          `yaml:"acks,omitempty"`     // op -> acknowledgements a quorum needs
+	Prefer   map[string]Endpoint     `yaml:"prefer,omitempty"`   // op -> endpoint winning merge conflicts
+	Failover map[string][]ErrorClass `yaml:"failover,omitempty"` // op -> errors fallback moves on after
+	Delay    map[string]HedgeDelay   `yaml:"delay,omitempty"`    // op -> wait before hedging
+	Verify   map[string]Verify       `yaml:"verify,omitempty"`   // op -> handling of mirrored copies that differ
+	Repair   map[string]Repair       `yaml:"repair,omitempty"`   // op -> handling of objects missing on the first endpoint
+}
+
+// Route is the outcome of routing one request.
+type Route struct {
+	Action   Action
+	Targets  []Endpoint   // ordered
+	Acks     int          // acknowledgements needed, for ActQuorum
+	Prefer   Endpoint     // side kept for keys on several endpoints, for ActMerge; "" keeps the newest
+	Failover []ErrorClass // errors that move on to the next endpoint, for serial actions; nil for DefaultFailover
+	Delay    HedgeDelay   // wait before asking the next endpoint, for ActHedge
+	Verify   Verify       // checksum mismatch handling, for ActMirror; "" skips verification
+	Repair   Repair       // read repair, for ActFallback; "" ignores divergence
 }
 
 // Config is the compiled configuration for the S3 router.
 type Config struct {
-	Endpoints map[Endpoint]string      `yaml:"endpoints"`
-	Buckets   map[string]BucketMapping `yaml:"buckets"`
-	Rules     []Rule                   `yaml:"rules"`
+	Endpoints     map[Endpoint]string      `yaml:"endpoints"`
+	EndpointOrder []Endpoint               `yaml:"endpoint_order"` // primary, secondary, then document order
+	Buckets       map[string]BucketMapping `yaml:"buckets"`
+	Rules         []Rule                   `yaml:"rules"`
 }
 
 // Load reads configuration from the given reader and returns a compiled Config.
@@ -63,14 +222,26 @@ func Load(r io.Reader) (*Config, error) {
 		return nil, err
 	}
 
-	endpoints := make(map[Endpoint]string, len(yml.Endpoints))
-	for k, v := range yml.Endpoints {
-		endpoints[Endpoint(k)] = v
+	endpoints, order, err := loadEndpoints(&yml.Endpoints)
+	if err != nil {
+		return nil, err
 	}
 	cfg := &Config{
-		Endpoints: endpoints,
-		Buckets:   yml.Buckets,
-		Rules:     make([]Rule, 0, len(yml.Rules)),
+		Endpoints:     endpoints,
+		EndpointOrder: order,
+		Buckets:       yml.Buckets,
+		Rules:         make([]Rule, 0, len(yml.Rules)),
+	}
+	known := make(map[Endpoint]bool, len(order))
+	for _, ep := range order {
+		known[ep] = true
+	}
+	for name, m := range cfg.Buckets {
+		for ep := range m {
+			if !known[ep] {
+				return nil, fmt.Errorf("bucket %q: unknown endpoint %q", name, ep)
+			}
+		}
 	}
 
 	for _, yr := range yml.Rules {
@@ -87,7 +258,104 @@ func Load(r io.Reader) (*Config, error) {
 				Actions: make(map[string]Action, len(actions)),
 			}
 			for op, action := range actions {
-				rule.Actions[op] = Action(action)
+				rule.Actions[op] = Action(action.Action)
+				n := len(order)
+				if action.Targets != nil {
+					if rule.Targets == nil {
+						rule.Targets = make(map[string][]Endpoint)
+					}
+					for _, t := range action.Targets {
+						if !known[Endpoint(t)] {
+							return nil, fmt.Errorf("bucket %q, prefix %q, op %s: unknown endpoint %q", yr.Bucket, prefix, op, t)
+						}
+						rule.Targets[op] = append(rule.Targets[op], Endpoint(t))
+					}
+					n = len(action.Targets)
+				}
+				if action.Acks != 0 {
+					if rule.Actions[op] != ActQuorum {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: acks is only valid for %s", yr.Bucket, prefix, op, ActQuorum)
+					}
+					if action.Acks < 1 || action.Acks > n {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: acks must be between 1 and %d", yr.Bucket, prefix, op, n)
+					}
+					if rule.Acks == nil {
+						rule.Acks = make(map[string]int)
+					}
+					rule.Acks[op] = action.Acks
+				}
+				if action.Prefer != "" {
+					if rule.Actions[op] != ActMerge {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: prefer is only valid for %s", yr.Bucket, prefix, op, ActMerge)
+					}
+					if !known[Endpoint(action.Prefer)] {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: unknown endpoint %q", yr.Bucket, prefix, op, action.Prefer)
+					}
+					if rule.Prefer == nil {
+						rule.Prefer = make(map[string]Endpoint)
+					}
+					rule.Prefer[op] = Endpoint(action.Prefer)
+				}
+				if rule.Actions[op] == ActHedge {
+					if op != "GetObject" && op != "HeadObject" {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: %s is only valid for GetObject and HeadObject", yr.Bucket, prefix, op, ActHedge)
+					}
+					delay := DefaultHedgeDelay
+					if action.Delay != "" {
+						var err error
+						if delay, err = parseHedgeDelay(action.Delay); err != nil {
+							return nil, fmt.Errorf("bucket %q, prefix %q, op %s: %w", yr.Bucket, prefix, op, err)
+						}
+					}
+					if rule.Delay == nil {
+						rule.Delay = make(map[string]HedgeDelay)
+					}
+					rule.Delay[op] = delay
+				} else if action.Delay != "" {
+					return nil, fmt.Errorf("bucket %q, prefix %q, op %s: delay is only valid for %s", yr.Bucket, prefix, op, ActHedge)
+				}
+				if action.Verify != "" {
+					if rule.Actions[op] != ActMirror {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: verify is only valid for %s", yr.Bucket, prefix, op, ActMirror)
+					}
+					if v := Verify(action.Verify); v != VerifyFail && v != VerifyFlag {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: verify must be %s or %s", yr.Bucket, prefix, op, VerifyFail, VerifyFlag)
+					}
+					if rule.Verify == nil {
+						rule.Verify = make(map[string]Verify)
+					}
+					rule.Verify[op] = Verify(action.Verify)
+				}
+				if action.Repair != "" {
+					if rule.Actions[op] != ActFallback {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: repair is only valid for %s", yr.Bucket, prefix, op, ActFallback)
+					}
+					if r := Repair(action.Repair); r != RepairCopy && r != RepairReport {
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: repair must be %s or %s", yr.Bucket, prefix, op, RepairCopy, RepairReport)
+					}
+					if rule.Repair == nil {
+						rule.Repair = make(map[string]Repair)
+					}
+					rule.Repair[op] = Repair(action.Repair)
+				}
+				if action.Failover != nil {
+					switch rule.Actions[op] {
+					case ActFallback, ActMigrateOnRead, ActMerge:
+					default:
+						return nil, fmt.Errorf("bucket %q, prefix %q, op %s: failover is only valid for %s, %s and %s", yr.Bucket, prefix, op, ActFallback, ActMigrateOnRead, ActMerge)
+					}
+					classes := make([]ErrorClass, len(action.Failover))
+					for i, c := range action.Failover {
+						classes[i] = ErrorClass(c)
+						if !slices.Contains(DefaultFailover, classes[i]) {
+							return nil, fmt.Errorf("bucket %q, prefix %q, op %s: unknown error class %q", yr.Bucket, prefix, op, c)
+						}
+					}
+					if rule.Failover == nil {
+						rule.Failover = make(map[string][]ErrorClass)
+					}
+					rule.Failover[op] = classes
+				}
 			}
 			cfg.Rules = append(cfg.Rules, rule)
 		}
@@ -112,6 +380,38 @@ func Load(r io.Reader) (*Config, error) {
 	return cfg, nil
 }
 
+// loadEndpoints decodes the endpoints mapping. The primary and secondary
+// endpoints always come first so two-endpoint configs keep their meaning;
+// any others follow in document order. Without an endpoints section the
+// order is primary, secondary.
+func loadEndpoints(n *yaml.Node) (map[Endpoint]string, []Endpoint, error) {
+	endpoints := make(map[Endpoint]string)
+	if n.Kind == 0 {
+		return endpoints, []Endpoint{EndpointPrimary, EndpointSecondary}, nil
+	}
+	if n.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("line %d: endpoints must be a mapping", n.Line)
+	}
+	var rest []Endpoint
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		name := Endpoint(n.Content[i].Value)
+		if _, dup := endpoints[name]; dup {
+			return nil, nil, fmt.Errorf("line %d: duplicate endpoint %q", n.Content[i].Line, name)
+		}
+		endpoints[name] = n.Content[i+1].Value
+		if name != EndpointPrimary && name != EndpointSecondary {
+			rest = append(rest, name)
+		}
+	}
+	var order []Endpoint
+	for _, ep := range []Endpoint{EndpointPrimary, EndpointSecondary} {
+		if _, ok := endpoints[ep]; ok {
+			order = append(order, ep)
+		}
+	}
+	return endpoints, append(order, rest...), nil
+}
+
 // Lookup finds the best matching rule and action for a given bucket, key, and operation.
 // If no matching rule is found, defaults to primary.
 func (cfg *Config) Lookup(bucket, key, op string) (Rule, Action) {
@@ -130,16 +430,101 @@ func (cfg *Config) Lookup(bucket, key, op string) (Rule, Action) {
 	return Rule{}, ActPrimary
 }
 
+// SubPrefixes returns, sorted, the prefixes of bucket's rules that extend
+// prefix, i.e. the parts of a listing under prefix that other rules route.
+func (cfg *Config) SubPrefixes(bucket, prefix string) []string {
+	var out []string
+	for _, rule := range cfg.Rules {
+		if rule.Bucket != bucket && rule.Bucket != "*" {
+			continue
+		}
+		if len(rule.Prefix) > len(prefix) && strings.HasPrefix(rule.Prefix, prefix) {
+			out = append(out, rule.Prefix)
+		}
+	}
+	sort.Strings(out)
+	return slices.Compact(out)
+}
+
+// Resolve routes op on bucket/key to an action and the ordered endpoints it
+// applies to. Rules without an explicit endpoint list apply to every endpoint
+// in EndpointOrder; a quorum without acks needs a majority of them.
+func (cfg *Config) Resolve(bucket, key, op string) Route {
+	rule, act := cfg.Lookup(bucket, key, op)
+	if _, ok := rule.Actions[op]; !ok {
+		op = "*"
+	}
+	return cfg.route(rule, act, op)
+}
+
+// route builds the route of act, the action rule gives op.
+func (cfg *Config) route(rule Rule, act Action, op string) Route {
+	r := Route{Action: act, Targets: cfg.EndpointOrder, Acks: rule.Acks[op], Prefer: rule.Prefer[op], Failover: rule.Failover[op], Delay: rule.Delay[op], Verify: rule.Verify[op], Repair: rule.Repair[op]}
+	if targets, ok := rule.Targets[op]; ok {
+		r.Targets = targets
+	}
+	if act == ActQuorum && r.Acks == 0 {
+		r.Acks = len(r.Targets)/2 + 1
+	}
+	return r
+}
+
+// Narrow returns the targets act sends requests to, out of the ordered
+// targets of its route: the first for ActPrimary, the second for
+// ActSecondary, and all of them otherwise.
+func Narrow[T any](act Action, targets []T) []T {
+	switch act {
+	case ActPrimary:
+		return targets[:min(1, len(targets))]
+	case ActSecondary:
+		return targets[min(1, len(targets)):min(2, len(targets))]
+	}
+	return targets
+}
+
+// BucketEndpoints returns, in EndpointOrder, the endpoints that some request
+// to bucket may be routed to, i.e. those its physical buckets must exist on.
+func (cfg *Config) BucketEndpoints(bucket string) []Endpoint {
+	used := make(map[Endpoint]bool)
+	root := false // whether a rule covers keys no other rule does
+	for _, rule := range cfg.Rules {
+		if rule.Bucket != bucket && rule.Bucket != "*" {
+			continue
+		}
+		root = root || rule.Prefix == ""
+		for op, act := range rule.Actions {
+			for _, ep := range Narrow(act, cfg.route(rule, act, op).Targets) {
+				used[ep] = true
+			}
+		}
+	}
+	if !root && len(cfg.EndpointOrder) > 0 {
+		used[cfg.EndpointOrder[0]] = true // unmatched keys go to the primary
+	}
+	var out []Endpoint
+	for _, ep := range cfg.EndpointOrder {
+		if used[ep] {
+			out = append(out, ep)
+		}
+	}
+	return out
+}
+
 // IsLogicalBucket returns true if the given bucket name is a logical bucket defined in the configuration.
 func (cfg *Config) IsLogicalBucket(bucket string) bool {
 	_, ok := cfg.Buckets[bucket]
 	return ok
 }
 
+// PhysicalBucket returns the physical bucket name for the given logical bucket on endpoint ep.
+func (cfg *Config) PhysicalBucket(logical string, ep Endpoint) string {
+	if b, ok := cfg.Buckets[logical][ep]; ok {
+		return b
+	}
+	return logical
+}
+
 // PhysicalBuckets returns the primary and secondary physical bucket names for the given logical bucket.
 func (cfg *Config) PhysicalBuckets(logical string) (string, string) {
-	if m, ok := cfg.Buckets[logical]; ok {
-		return m.Primary, m.Secondary
-	}
-	return logical, logical
+	return cfg.PhysicalBucket(logical, EndpointPrimary), cfg.PhysicalBucket(logical, EndpointSecondary)
 }
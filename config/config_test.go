@@ -44,10 +44,11 @@ rules:
 					EndpointPrimary:   "http://primary:9000",
 					EndpointSecondary: "http://secondary:9000",
 				},
+				EndpointOrder: []Endpoint{EndpointPrimary, EndpointSecondary},
 				Buckets: map[string]BucketMapping{
 					"photos": {
-						Primary:   "photos",
-						Secondary: "cf-photos",
+						EndpointPrimary:   "photos",
+						EndpointSecondary: "cf-photos",
 					},
 				},
 				Rules: []Rule{
@@ -79,6 +80,152 @@ rules:
 				},
 			},
 		},
+		{
+			name: "three endpoints with explicit targets",
+			yaml: `
+endpoints:
+  minio: http://minio:9000
+  secondary: https://r2.cloudflarestorage.com
+  primary: https://s3.amazonaws.com
+
+buckets:
+  photos:
+    primary: photos
+    secondary: cf-photos
+    minio: photos-onprem
+
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        GetObject:
+          fallback: [minio, primary, secondary]
+        "*":
+          mirror: [primary, minio]
+`,
+			want: &Config{
+				Endpoints: map[Endpoint]string{
+					EndpointPrimary:   "https://s3.amazonaws.com",
+					EndpointSecondary: "https://r2.cloudflarestorage.com",
+					"minio":           "http://minio:9000",
+				},
+				EndpointOrder: []Endpoint{EndpointPrimary, EndpointSecondary, "minio"},
+				Buckets: map[string]BucketMapping{
+					"photos": {
+						EndpointPrimary:   "photos",
+						EndpointSecondary: "cf-photos",
+						"minio":           "photos-onprem",
+					},
+				},
+				Rules: []Rule{
+					{
+						Bucket: "photos",
+						Prefix: "",
+						Actions: map[string]Action{
+							"GetObject": ActFallback,
+							"*":         ActMirror,
+						},
+						Targets: map[string][]Endpoint{
+							"GetObject": {"minio", EndpointPrimary, EndpointSecondary},
+							"*":         {EndpointPrimary, "minio"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "unknown target endpoint",
+			yaml: `
+endpoints:
+  primary: http://primary:9000
+  secondary: http://secondary:9000
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          mirror: [primary, tertiary]
+`,
+			wantErr: `unknown endpoint "tertiary"`,
+		},
+		{
+			name: "quorum acks exceed targets",
+			yaml: `
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          quorum: [primary, secondary]
+          acks: 3
+`,
+			wantErr: "acks must be between 1 and 2",
+		},
+		{
+			name: "prefer without merge",
+			yaml: `
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          fallback:
+          prefer: secondary
+`,
+			wantErr: "prefer is only valid for merge",
+		},
+		{
+			name: "hedged write",
+			yaml: `
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          hedge:
+          delay: 50ms
+`,
+			wantErr: "hedge is only valid for GetObject and HeadObject",
+		},
+		{
+			name: "unknown error class",
+			yaml: `
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          fallback:
+          failover: [5xx, teapot]
+`,
+			wantErr: `unknown error class "teapot"`,
+		},
+		{
+			name: "unknown verify mode",
+			yaml: `
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          mirror:
+          verify: maybe
+`,
+			wantErr: "verify must be fail or flag",
+		},
+		{
+			name: "repair without fallback",
+			yaml: `
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          mirror:
+          repair: copy
+`,
+			wantErr: "repair is only valid for fallback",
+		},
 	}
 
 	for _, tc := range tests {
@@ -102,3 +249,112 @@ rules:
 		})
 	}
 }
+
+func TestResolve(t *testing.T) {
+	cfg, err := Load(strings.NewReader(`
+endpoints:
+  primary: http://primary:9000
+  secondary: http://secondary:9000
+  minio: http://minio:9000
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "raw/":
+        GetObject:
+          fallback: [minio, primary]
+        PutObject:
+          quorum:
+          acks: 2
+        DeleteObject:
+          quorum: [primary, minio]
+        HeadObject:
+          fallback:
+          failover: [5xx, network]
+          repair: report
+        "*": mirror
+      "hot/":
+        GetObject:
+          hedge: [primary, minio]
+          delay: p99
+        PutObject:
+          mirror:
+          verify: flag
+        "*": primary
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	all := []Endpoint{EndpointPrimary, EndpointSecondary, "minio"}
+	tests := []struct {
+		key, op string
+		want    Route
+	}{
+		{"raw/a", "GetObject", Route{Action: ActFallback, Targets: []Endpoint{"minio", EndpointPrimary}}},
+		{"raw/a", "PutObject", Route{Action: ActQuorum, Targets: all, Acks: 2}},
+		{"raw/a", "DeleteObject", Route{Action: ActQuorum, Targets: []Endpoint{EndpointPrimary, "minio"}, Acks: 2}},
+		{"raw/a", "HeadObject", Route{Action: ActFallback, Targets: all, Failover: []ErrorClass{ErrServer, ErrNetwork}, Repair: RepairReport}},
+		{"raw/a", "ListParts", Route{Action: ActMirror, Targets: all}},
+		{"hot/a", "GetObject", Route{Action: ActHedge, Targets: []Endpoint{EndpointPrimary, "minio"}, Delay: HedgeDelay{Percentile: 99}}},
+		{"hot/a", "PutObject", Route{Action: ActMirror, Targets: all, Verify: VerifyFlag}},
+		{"other", "PutObject", Route{Action: ActPrimary, Targets: all}},
+	}
+	for _, tc := range tests {
+		got := cfg.Resolve("photos", tc.key, tc.op)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Resolve(%q, %q) = %+v, want %+v", tc.key, tc.op, got, tc.want)
+		}
+	}
+}
+
+func TestBucketEndpoints(t *testing.T) {
+	cfg, err := Load(strings.NewReader(`
+endpoints:
+  primary: http://primary:9000
+  secondary: http://secondary:9000
+  minio: http://minio:9000
+rules:
+  - bucket: photos
+    prefix:
+      "raw/":
+        GetObject:
+          fallback: [minio, primary]
+        "*": secondary
+  - bucket: logs
+    prefix:
+      "*":
+        "*": mirror
+  - bucket: cold
+    prefix:
+      "*":
+        GetObject:
+          fallback: [minio, secondary]
+        "*": secondary
+  - bucket: archive
+    prefix:
+      "*":
+        PutObject:
+          secondary: [primary, minio]
+        "*": primary
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	for bucket, want := range map[string][]Endpoint{
+		"photos":  {EndpointPrimary, EndpointSecondary, "minio"},
+		"logs":    {EndpointPrimary, EndpointSecondary, "minio"},
+		"cold":    {EndpointSecondary, "minio"},
+		"archive": {EndpointPrimary, "minio"},
+		"other":   {EndpointPrimary},
+	} {
+		if got := cfg.BucketEndpoints(bucket); !reflect.DeepEqual(got, want) {
+			t.Errorf("BucketEndpoints(%q) = %v, want %v", bucket, got, want)
+		}
+	}
+	// the override is what Resolve routes archive writes to
+	r := cfg.Resolve("archive", "k", "PutObject")
+	if got := Narrow(r.Action, r.Targets); !reflect.DeepEqual(got, []Endpoint{"minio"}) {
+		t.Errorf("Resolve(archive, PutObject) sends to %v, want [minio]", got)
+	}
+}
@@ -0,0 +1,322 @@
+package s3router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/replicate"
+	"github.com/wilbeibi/s3router/store"
+)
+
+// WithCopyPartSize sets the part size of copies streamed from one endpoint
+// to another; larger objects are copied with a multipart upload. Defaults
+// to 64 MiB. Most endpoints need parts of at least 5 MiB.
+func WithCopyPartSize(n int64) Option {
+	return func(c *router) {
+		c.copyPartSize = n
+	}
+}
+
+// CopyObject copies an object within or across logical buckets. The source
+// is read as GetObject would read it, failing over between its endpoints
+// as its rule says. Each endpoint the destination routes to copies
+// server-side if it holds the source too, and otherwise streams the object
+// from an endpoint that does, keeping its metadata and tags.
+func (c *router) CopyObject(ctx context.Context, in *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	const op = "CopyObject"
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	src, err := c.copySources(aws.ToString(in.CopySource))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	rt, err := c.route(op, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	c.journal(&rt, replicate.KindCopy, bucket, key)
+	c.rollbackWrite(&rt, key)
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.CopyObjectOutput, error) {
+			return fromSource(ctx, src, t, func(s target) (*s3.CopyObjectOutput, error) {
+				if s.name != t.name {
+					return c.copyAcross(ctx, src, s, t, in, optFns...)
+				}
+				in := *in
+				in.Bucket = aws.String(t.bucket)
+				in.CopySource = aws.String(copySource(s.bucket, src.key, src.versionID))
+				out, err := t.st.CopyObject(ctx, &in, optFns...)
+				if err != nil {
+					return nil, &sourceError{err}
+				}
+				return out, nil
+			})
+		},
+	)
+}
+
+// copySrc is the source object of a copy and where it may be read from.
+type copySrc struct {
+	key       string
+	versionID *string
+	targets   []target // most preferred first
+	failover  []config.ErrorClass
+}
+
+// copySources parses a CopySource and returns where its object may be read
+// from. A version ID only names a version on one endpoint, so a versioned
+// source is read from the most preferred endpoint alone.
+func (c *router) copySources(source string) (copySrc, error) {
+	bucket, key, versionID, err := parseCopySource(source)
+	if err != nil {
+		return copySrc{}, err
+	}
+	if !c.cfg.IsLogicalBucket(bucket) {
+		return copySrc{}, fmt.Errorf("source bucket %q is not configured", bucket)
+	}
+	rt, _ := c.route("GetObject", bucket, key)
+	src := copySrc{key: key, versionID: versionID, targets: readTargets(rt), failover: rt.failover}
+	if versionID != nil {
+		src.targets = src.targets[:1]
+	}
+	return src, nil
+}
+
+// sourceError is a failure to read the source of a copy, after which the
+// copy may be tried again from the next source endpoint.
+type sourceError struct{ err error }
+
+func (e *sourceError) Error() string { return e.err.Error() }
+func (e *sourceError) Unwrap() error { return e.err }
+
+// fromSource runs copy with each endpoint the source may be read from,
+// starting with dst itself if it is one, until a copy succeeds or fails
+// with an error that is not a sourceError the source rule fails over on.
+func fromSource[T any](ctx context.Context, src copySrc, dst target, copy func(s target) (T, error)) (T, error) {
+	order := src.targets
+	if i := slices.IndexFunc(order, func(s target) bool { return s.name == dst.name }); i > 0 {
+		order = append([]target{order[i]}, slices.Delete(slices.Clone(order), i, i+1)...)
+	}
+	var (
+		out T
+		err error
+	)
+	for _, s := range order {
+		out, err = copy(s)
+		var se *sourceError
+		if err == nil || !errors.As(err, &se) || !failsOver(ctx, se.err, src.failover) {
+			break
+		}
+	}
+	return out, err
+}
+
+// readTargets returns the targets a read routed by rt may be served from,
+// most preferred first.
+func readTargets(rt route) []target {
+	return config.Narrow(rt.action, rt.targets)
+}
+
+// parseCopySource splits a CopySource of the form "bucket/key", with an
+// optional leading slash and "?versionId=" suffix.
+func parseCopySource(s string) (bucket, key string, versionID *string, err error) {
+	s, query, _ := strings.Cut(strings.TrimPrefix(s, "/"), "?")
+	bucket, key, ok := strings.Cut(s, "/")
+	if !ok || bucket == "" || key == "" {
+		return "", "", nil, fmt.Errorf("invalid copy source %q", s)
+	}
+	if key, err = url.PathUnescape(key); err != nil {
+		return "", "", nil, fmt.Errorf("invalid copy source %q: %w", s, err)
+	}
+	if query != "" {
+		v, err := url.ParseQuery(query)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid copy source %q: %w", s, err)
+		}
+		if id := v.Get("versionId"); id != "" {
+			versionID = aws.String(id)
+		}
+	}
+	return bucket, key, versionID, nil
+}
+
+func copySource(bucket, key string, versionID *string) string {
+	s := bucket + "/" + (&url.URL{Path: key}).EscapedPath()
+	if versionID != nil {
+		s += "?versionId=" + url.QueryEscape(*versionID)
+	}
+	return s
+}
+
+// copyAcross streams the source object from src to dst as CopyObject would
+// copy it, with a multipart upload if it is larger than copyPartSize.
+func (c *router) copyAcross(
+	ctx context.Context,
+	from copySrc,
+	src target,
+	dst target,
+	in *s3.CopyObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.CopyObjectOutput, error) {
+	head, err := src.st.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:            aws.String(src.bucket),
+		Key:               aws.String(from.key),
+		VersionId:         from.versionID,
+		IfMatch:           in.CopySourceIfMatch,
+		IfNoneMatch:       in.CopySourceIfNoneMatch,
+		IfModifiedSince:   in.CopySourceIfModifiedSince,
+		IfUnmodifiedSince: in.CopySourceIfUnmodifiedSince,
+	}, optFns...)
+	if err != nil {
+		return nil, &sourceError{err}
+	}
+	// Later reads must see the same object, even if it is overwritten.
+	etag := head.ETag
+
+	h := objectHeaders{
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		CacheControl:       head.CacheControl,
+		Expires:            head.Expires,
+		Metadata:           head.Metadata,
+	}
+	if in.MetadataDirective == types.MetadataDirectiveReplace {
+		h = objectHeaders{
+			ContentType:        in.ContentType,
+			ContentEncoding:    in.ContentEncoding,
+			ContentDisposition: in.ContentDisposition,
+			ContentLanguage:    in.ContentLanguage,
+			CacheControl:       in.CacheControl,
+			Expires:            in.Expires,
+			Metadata:           in.Metadata,
+		}
+	}
+	tagging := in.Tagging
+	if in.TaggingDirective != types.TaggingDirectiveReplace {
+		if tagging, err = store.Tagging(ctx, src.st, src.bucket, from.key, from.versionID, optFns...); err != nil {
+			return nil, &sourceError{err}
+		}
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	if size <= c.copyPartSize {
+		obj, err := src.st.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:    aws.String(src.bucket),
+			Key:       aws.String(from.key),
+			VersionId: from.versionID,
+			IfMatch:   etag,
+		}, optFns...)
+		if err != nil {
+			return nil, &sourceError{err}
+		}
+		defer obj.Body.Close()
+		out, err := dst.st.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:             aws.String(dst.bucket),
+			Key:                in.Key,
+			Body:               obj.Body,
+			ContentLength:      obj.ContentLength,
+			ContentType:        h.ContentType,
+			ContentEncoding:    h.ContentEncoding,
+			ContentDisposition: h.ContentDisposition,
+			ContentLanguage:    h.ContentLanguage,
+			CacheControl:       h.CacheControl,
+			Expires:            h.Expires,
+			Metadata:           h.Metadata,
+			Tagging:            tagging,
+			StorageClass:       in.StorageClass,
+		}, optFns...)
+		if err != nil {
+			return nil, err
+		}
+		return &s3.CopyObjectOutput{
+			CopyObjectResult: &types.CopyObjectResult{ETag: out.ETag},
+			VersionId:        out.VersionId,
+		}, nil
+	}
+
+	created, err := dst.st.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(dst.bucket),
+		Key:                in.Key,
+		ContentType:        h.ContentType,
+		ContentEncoding:    h.ContentEncoding,
+		ContentDisposition: h.ContentDisposition,
+		ContentLanguage:    h.ContentLanguage,
+		CacheControl:       h.CacheControl,
+		Expires:            h.Expires,
+		Metadata:           h.Metadata,
+		Tagging:            tagging,
+		StorageClass:       in.StorageClass,
+	}, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	abort := func(err error) (*s3.CopyObjectOutput, error) {
+		_, _ = dst.st.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(dst.bucket),
+			Key:      in.Key,
+			UploadId: created.UploadId,
+		}, optFns...)
+		return nil, err
+	}
+	var parts []types.CompletedPart
+	for off, n := int64(0), int32(1); off < size; off, n = off+c.copyPartSize, n+1 {
+		end := min(off+c.copyPartSize, size) - 1
+		obj, err := src.st.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:    aws.String(src.bucket),
+			Key:       aws.String(from.key),
+			VersionId: from.versionID,
+			IfMatch:   etag,
+			Range:     aws.String(fmt.Sprintf("bytes=%d-%d", off, end)),
+		}, optFns...)
+		if err != nil {
+			return abort(err)
+		}
+		part, err := dst.st.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(dst.bucket),
+			Key:           in.Key,
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int32(n),
+			Body:          obj.Body,
+			ContentLength: aws.Int64(end - off + 1),
+		}, optFns...)
+		obj.Body.Close()
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(n)})
+	}
+	out, err := dst.st.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dst.bucket),
+		Key:             in.Key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}, optFns...)
+	if err != nil {
+		return abort(err)
+	}
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &types.CopyObjectResult{ETag: out.ETag},
+		VersionId:        out.VersionId,
+	}, nil
+}
+
+// objectHeaders are the content headers and user metadata a copy keeps.
+type objectHeaders struct {
+	ContentType        *string
+	ContentEncoding    *string
+	ContentDisposition *string
+	ContentLanguage    *string
+	CacheControl       *string
+	Expires            *time.Time
+	Metadata           map[string]string
+}
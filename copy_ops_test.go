@@ -0,0 +1,144 @@
+package s3router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const splitYAML = `
+buckets:
+  photos:
+    primary: photos
+    secondary: cf-photos
+rules:
+  - bucket: photos
+    prefix:
+      "a/":
+        "*": primary
+      "b/":
+        "*": secondary
+      "f/":
+        "*": fallback
+      "*":
+        "*": mirror
+`
+
+func TestCopyObject(t *testing.T) {
+	ctx := context.Background()
+	want := "0123456789"
+	for _, tc := range []struct {
+		name, dst    string
+		partSize     int64
+		pCopy, sCopy int // server-side copies on each endpoint
+	}{
+		{"same endpoint", "a/y", 64, 1, 0},
+		{"across endpoints", "b/y", 64, 0, 0},
+		{"across endpoints, multipart", "b/y", 4, 0, 0},
+		{"to a mirror", "m/y", 64, 1, 0},
+	} {
+		p, s := newMemStore("p"), newMemStore("s")
+		p.objects["photos/a/x"] = []byte(want)
+		r, _ := New(mustLoad(t, splitYAML), p, s, WithCopyPartSize(tc.partSize))
+
+		_, err := r.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String(tc.dst), CopySource: aws.String("photos/a/x"),
+		})
+		if err != nil {
+			t.Fatalf("%s: CopyObject: %v", tc.name, err)
+		}
+		if p.copies != tc.pCopy || s.copies != tc.sCopy {
+			t.Errorf("%s: server-side copies = %d, %d, want %d, %d", tc.name, p.copies, s.copies, tc.pCopy, tc.sCopy)
+		}
+		for _, c := range []struct {
+			st     *memStore
+			bucket string
+			want   bool
+		}{{p, "photos", tc.dst != "b/y"}, {s, "cf-photos", tc.dst != "a/y"}} {
+			got, ok := c.st.object(c.bucket, tc.dst)
+			if ok != c.want || (ok && string(got) != want) {
+				t.Errorf("%s: %s has %q (%v), want it: %v", tc.name, c.st.name, got, ok, c.want)
+			}
+		}
+	}
+}
+
+func TestCopyObject_SourceFallback(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name, source string
+		ok           bool
+	}{
+		{"falls back to the secondary", "photos/f/x", true},
+		{"version IDs name one endpoint's version", "photos/f/x?versionId=v1", false},
+	} {
+		p, s := newMemStore("p"), newMemStore("s")
+		s.objects["cf-photos/f/x"] = []byte("data")
+		r, _ := New(mustLoad(t, splitYAML), p, s)
+
+		_, err := r.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String("a/y"), CopySource: aws.String(tc.source),
+		})
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: CopyObject: %v, want success: %v", tc.name, err, tc.ok)
+		}
+		if got, ok := p.object("photos", "a/y"); ok != tc.ok || (ok && string(got) != "data") {
+			t.Errorf("%s: primary has %q (%v)", tc.name, got, ok)
+		}
+	}
+}
+
+// headStore records the last HeadObject request it was sent.
+type headStore struct {
+	*memStore
+	head *s3.HeadObjectInput
+}
+
+func (h *headStore) HeadObject(ctx context.Context, in *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	h.head = in
+	return h.memStore.HeadObject(ctx, in, optFns...)
+}
+
+func TestCopyObject_SourceConditions(t *testing.T) {
+	p := &headStore{memStore: newMemStore("p")}
+	p.objects["photos/a/x"] = []byte("data")
+	r, _ := New(mustLoad(t, splitYAML), p, newMemStore("s"))
+
+	since := time.Unix(1700000000, 0)
+	_, err := r.CopyObject(context.Background(), &s3.CopyObjectInput{
+		Bucket: aws.String("photos"), Key: aws.String("b/y"), CopySource: aws.String("photos/a/x"),
+		CopySourceIfMatch: aws.String("m"), CopySourceIfNoneMatch: aws.String("n"),
+		CopySourceIfModifiedSince: aws.Time(since), CopySourceIfUnmodifiedSince: aws.Time(since),
+	})
+	if err != nil {
+		t.Fatalf("CopyObject: %v", err)
+	}
+	h := p.head
+	if h == nil || aws.ToString(h.IfMatch) != "m" || aws.ToString(h.IfNoneMatch) != "n" ||
+		!aws.ToTime(h.IfModifiedSince).Equal(since) || !aws.ToTime(h.IfUnmodifiedSince).Equal(since) {
+		t.Errorf("source HEAD = %+v, want every CopySource condition", h)
+	}
+}
+
+func TestParseCopySource(t *testing.T) {
+	for _, tc := range []struct {
+		in, bucket, key, version string
+	}{
+		{"photos/a/b.jpg", "photos", "a/b.jpg", ""},
+		{"/photos/a%20b.jpg?versionId=v1", "photos", "a b.jpg", "v1"},
+	} {
+		bucket, key, version, err := parseCopySource(tc.in)
+		if err != nil || bucket != tc.bucket || key != tc.key || aws.ToString(version) != tc.version {
+			t.Errorf("parseCopySource(%q) = %q, %q, %q, %v", tc.in, bucket, key, aws.ToString(version), err)
+		}
+		if got := copySource(bucket, key, version); "/"+got != tc.in && got != tc.in {
+			t.Errorf("copySource(%q, %q) = %q, want %q", bucket, key, got, tc.in)
+		}
+	}
+	if _, _, _, err := parseCopySource("photos"); err == nil {
+		t.Errorf("parseCopySource(%q): want an error", "photos")
+	}
+}
@@ -0,0 +1,154 @@
+package s3router
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/wilbeibi/s3router/config"
+)
+
+const (
+	// minLatencySamples is how many responses an endpoint needs before a
+	// percentile delay is taken from them; until then defaultHedgeAfter is.
+	minLatencySamples = 20
+	defaultHedgeAfter = 100 * time.Millisecond
+)
+
+// latencies keeps an endpoint's recent successful response times.
+type latencies struct {
+	mu      sync.Mutex
+	samples [256]time.Duration
+	next    int
+	count   int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % len(l.samples)
+	l.count = min(l.count+1, len(l.samples))
+}
+
+// percentile returns the p-th percentile of the recent samples, and false
+// if there are too few of them.
+func (l *latencies) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	s := slices.Clone(l.samples[:l.count])
+	l.mu.Unlock()
+	if len(s) < minLatencySamples {
+		return 0, false
+	}
+	slices.Sort(s)
+	return s[int(float64(len(s)-1)*p/100)], true
+}
+
+// hedgeAfter is how long to wait for t before also asking the next target.
+func hedgeAfter(delay config.HedgeDelay, t target) time.Duration {
+	if delay.Duration > 0 {
+		return delay.Duration
+	}
+	if d, ok := t.lat.percentile(delay.Percentile); ok {
+		return d
+	}
+	return defaultHedgeAfter
+}
+
+// doHedge asks targets in order, moving on to the next when the latest has
+// not answered within its delay or has failed. The first success wins; the
+// other requests are cancelled and their outputs discarded.
+func doHedge[T any](
+	ctx context.Context,
+	delay config.HedgeDelay,
+	op func(context.Context, target) (T, error),
+	targets []target,
+) (T, error) {
+	type result struct {
+		i   int
+		out T
+		err error
+	}
+	results := make(chan result, len(targets))
+	cancels := make([]context.CancelFunc, len(targets))
+	var (
+		launched, pending int
+		next              <-chan time.Time
+	)
+	launch := func() {
+		i := launched
+		t := targets[i]
+		ctx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		launched++
+		pending++
+		next = nil
+		if launched < len(targets) {
+			next = time.After(hedgeAfter(delay, t))
+		}
+		go func() {
+			start := time.Now()
+			out, err := op(ctx, t)
+			if err == nil {
+				t.lat.add(time.Since(start))
+			}
+			results <- result{i, out, err}
+		}()
+	}
+
+	launch()
+	var err error
+	for pending > 0 {
+		select {
+		case <-next:
+			launch()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				cancels[r.i]()
+				err = r.err
+				if launched < len(targets) && ctx.Err() == nil {
+					launch()
+				}
+				continue
+			}
+			for i, cancel := range cancels[:launched] {
+				if i != r.i {
+					cancel()
+				}
+			}
+			go func() {
+				for range pending {
+					discard((<-results).out)
+				}
+			}()
+			return keep(r.out, cancels[r.i]), nil
+		}
+	}
+	var zero T
+	return zero, err
+}
+
+// keep releases the context of a winning request once its output is done
+// with: a GetObject body is read through it, so that is when it is closed.
+func keep[T any](out T, cancel context.CancelFunc) T {
+	if o, ok := any(out).(*s3.GetObjectOutput); ok && o != nil && o.Body != nil {
+		o.Body = &cancelOnClose{ReadCloser: o.Body, cancel: cancel}
+		return out
+	}
+	cancel()
+	return out
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
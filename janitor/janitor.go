@@ -0,0 +1,243 @@
+// Package janitor aborts multipart uploads that were started long ago and
+// never completed. A mirrored upload that failed part-way can leave an
+// upload open on one endpoint or several, and its parts are billed until
+// it is aborted.
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/store"
+)
+
+// Aborted is one stale upload the janitor aborted, or tried to.
+type Aborted struct {
+	Endpoint  config.Endpoint
+	Bucket    string // physical bucket
+	Key       string
+	UploadID  string
+	Initiated time.Time
+	Err       error // abort error, if any
+}
+
+// Report summarises one sweep over every physical bucket.
+type Report struct {
+	Scanned int // uploads listed
+	Aborted []Aborted
+}
+
+// Option configures a Janitor.
+type Option func(*Janitor)
+
+// WithUploadStore drops the router's mapping of every upload the janitor
+// aborts. Pass the store given to s3router.WithUploadStore. Mappings are
+// keyed by the upload ID of the endpoint that led; the lead of an upload
+// aborted on another endpoint is found among the same key's uploads in
+// progress.
+func WithUploadStore(s store.UploadStore) Option {
+	return func(j *Janitor) {
+		j.uploads = s
+	}
+}
+
+// WithReport sets a function called with the outcome of every sweep Run
+// makes.
+func WithReport(fn func(*Report, error)) Option {
+	return func(j *Janitor) {
+		j.report = fn
+	}
+}
+
+// Janitor aborts multipart uploads older than a maximum age on every
+// physical bucket of the configuration.
+type Janitor struct {
+	cfg     *config.Config
+	stores  map[config.Endpoint]store.Store
+	maxAge  time.Duration
+	uploads store.UploadStore // nil without WithUploadStore
+	report  func(*Report, error)
+}
+
+func New(cfg *config.Config, stores map[config.Endpoint]store.Store, maxAge time.Duration, opts ...Option) *Janitor {
+	j := &Janitor{cfg: cfg, stores: stores, maxAge: maxAge}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j
+}
+
+// Run sweeps now and then every interval until ctx is done.
+func (j *Janitor) Run(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		rep, err := j.Sweep(ctx)
+		if j.report != nil && ctx.Err() == nil {
+			j.report(rep, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Sweep lists the uploads in progress on every physical bucket of the
+// configuration and aborts those initiated more than maxAge ago. It goes on
+// past buckets it cannot list and uploads it cannot abort, and returns
+// their errors together.
+func (j *Janitor) Sweep(ctx context.Context) (*Report, error) {
+	rep := &Report{}
+	cutoff := time.Now().Add(-j.maxAge)
+	var errs []error
+	for _, b := range j.buckets() {
+		if err := j.sweep(ctx, b, cutoff, rep); err != nil {
+			errs = append(errs, fmt.Errorf("janitor: %s/%s: %w", b.ep, b.name, err))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return rep, errors.Join(errs...)
+}
+
+// physicalBucket is a bucket on one endpoint.
+type physicalBucket struct {
+	ep   config.Endpoint
+	name string
+}
+
+// buckets returns every physical bucket some rule can send requests to,
+// each once, in a stable order.
+func (j *Janitor) buckets() []physicalBucket {
+	logical := make([]string, 0, len(j.cfg.Buckets))
+	for name := range j.cfg.Buckets {
+		logical = append(logical, name)
+	}
+	slices.Sort(logical)
+	var out []physicalBucket
+	for _, name := range logical {
+		for _, ep := range j.cfg.BucketEndpoints(name) {
+			b := physicalBucket{ep, j.cfg.PhysicalBucket(name, ep)}
+			if !slices.Contains(out, b) {
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
+// sweep aborts the stale uploads in b, a page at a time.
+func (j *Janitor) sweep(ctx context.Context, b physicalBucket, cutoff time.Time, rep *Report) error {
+	st := j.stores[b.ep]
+	if st == nil {
+		return fmt.Errorf("no store for endpoint %q", b.ep)
+	}
+	in := &s3.ListMultipartUploadsInput{Bucket: aws.String(b.name)}
+	var errs []error
+	for {
+		page, err := st.ListMultipartUploads(ctx, in)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		for _, u := range page.Uploads {
+			rep.Scanned++
+			if !aws.ToTime(u.Initiated).Before(cutoff) {
+				continue
+			}
+			a := Aborted{
+				Endpoint:  b.ep,
+				Bucket:    b.name,
+				Key:       aws.ToString(u.Key),
+				UploadID:  aws.ToString(u.UploadId),
+				Initiated: aws.ToTime(u.Initiated),
+			}
+			_, a.Err = st.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(b.name),
+				Key:      u.Key,
+				UploadId: u.UploadId,
+			})
+			var gone *types.NoSuchUpload
+			if errors.As(a.Err, &gone) {
+				continue // completed or aborted since it was listed
+			}
+			if a.Err == nil && j.uploads != nil {
+				if lead := j.leadID(ctx, b, a.Key, a.UploadID); lead != "" {
+					_ = j.uploads.Delete(ctx, lead)
+				}
+			}
+			if a.Err != nil {
+				errs = append(errs, fmt.Errorf("abort %s %s: %w", a.Key, a.UploadID, a.Err))
+			}
+			rep.Aborted = append(rep.Aborted, a)
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return errors.Join(errs...)
+		}
+		in.KeyMarker, in.UploadIdMarker = page.NextKeyMarker, page.NextUploadIdMarker
+	}
+}
+
+// leadID returns the ID the router keys the mapping of upload id of key in
+// b by: id itself if that upload led, or else the ID of the upload of key on
+// another endpoint whose mapping names id. It returns "" if there is none.
+func (j *Janitor) leadID(ctx context.Context, b physicalBucket, key, id string) string {
+	if _, err := j.uploads.Get(ctx, id); err == nil {
+		return id
+	}
+	for _, p := range j.peers(b) {
+		st := j.stores[p.ep]
+		if st == nil {
+			continue
+		}
+		in := &s3.ListMultipartUploadsInput{Bucket: aws.String(p.name), Prefix: aws.String(key)}
+		for {
+			page, err := st.ListMultipartUploads(ctx, in)
+			if err != nil {
+				break
+			}
+			for _, u := range page.Uploads {
+				if aws.ToString(u.Key) != key {
+					continue
+				}
+				m, err := j.uploads.Get(ctx, aws.ToString(u.UploadId))
+				if err == nil && m.UploadIDs[string(b.ep)] == id {
+					return aws.ToString(u.UploadId)
+				}
+			}
+			if !aws.ToBool(page.IsTruncated) {
+				break
+			}
+			in.KeyMarker, in.UploadIdMarker = page.NextKeyMarker, page.NextUploadIdMarker
+		}
+	}
+	return ""
+}
+
+// peers returns the buckets on other endpoints that share a logical bucket
+// with b, i.e. where the rest of an upload to b may have been started.
+func (j *Janitor) peers(b physicalBucket) []physicalBucket {
+	var out []physicalBucket
+	for logical := range j.cfg.Buckets {
+		eps := j.cfg.BucketEndpoints(logical)
+		if !slices.Contains(eps, b.ep) || j.cfg.PhysicalBucket(logical, b.ep) != b.name {
+			continue
+		}
+		for _, ep := range eps {
+			p := physicalBucket{ep, j.cfg.PhysicalBucket(logical, ep)}
+			if ep != b.ep && !slices.Contains(out, p) {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
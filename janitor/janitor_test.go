@@ -0,0 +1,180 @@
+package janitor
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/store"
+)
+
+// uploadStore holds uploads in progress, listed pageSize at a time.
+type uploadStore struct {
+	store.Store
+	mu       sync.Mutex
+	uploads  []upload
+	pageSize int
+}
+
+type upload struct {
+	bucket, key, id string
+	initiated       time.Time
+}
+
+func (u *uploadStore) ListMultipartUploads(_ context.Context, in *s3.ListMultipartUploadsInput, _ ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ups []upload
+	for _, up := range u.uploads {
+		if up.bucket == aws.ToString(in.Bucket) {
+			ups = append(ups, up)
+		}
+	}
+	sort.Slice(ups, func(i, j int) bool { return ups[i].key+"/"+ups[i].id < ups[j].key+"/"+ups[j].id })
+	after := aws.ToString(in.KeyMarker) + "/" + aws.ToString(in.UploadIdMarker)
+	start := 0
+	if in.KeyMarker != nil {
+		start = sort.Search(len(ups), func(i int) bool { return ups[i].key+"/"+ups[i].id > after })
+	}
+	end := min(start+u.pageSize, len(ups))
+	out := &s3.ListMultipartUploadsOutput{IsTruncated: aws.Bool(end < len(ups))}
+	if end < len(ups) {
+		out.NextKeyMarker, out.NextUploadIdMarker = aws.String(ups[end-1].key), aws.String(ups[end-1].id)
+	}
+	for _, up := range ups[start:end] {
+		out.Uploads = append(out.Uploads, types.MultipartUpload{
+			Key: aws.String(up.key), UploadId: aws.String(up.id), Initiated: aws.Time(up.initiated),
+		})
+	}
+	return out, nil
+}
+
+func (u *uploadStore) AbortMultipartUpload(_ context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, up := range u.uploads {
+		if up.bucket == aws.ToString(in.Bucket) && up.id == aws.ToString(in.UploadId) {
+			u.uploads = append(u.uploads[:i], u.uploads[i+1:]...)
+			return &s3.AbortMultipartUploadOutput{}, nil
+		}
+	}
+	return nil, &types.NoSuchUpload{}
+}
+
+func (u *uploadStore) ids() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ids []string
+	for _, up := range u.uploads {
+		ids = append(ids, up.bucket+"/"+up.id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+const testYAML = `
+buckets:
+  photos:
+    primary: photos
+    secondary: cf-photos
+  logs:
+    primary: logs
+    secondary: cf-logs
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": mirror
+  - bucket: logs
+    prefix:
+      "*":
+        "*": primary
+`
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := config.Load(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, fresh := time.Now().Add(-48*time.Hour), time.Now()
+	p := &uploadStore{pageSize: 1, uploads: []upload{
+		{"photos", "a", "p1", old},
+		{"photos", "b", "p2", fresh},
+		{"photos", "c", "p3", old},
+		{"logs", "l", "p4", old},
+	}}
+	s := &uploadStore{pageSize: 1, uploads: []upload{
+		{"cf-photos", "a", "s1", old},
+		{"cf-photos", "b", "s2", fresh},
+		{"cf-logs", "l", "s3", old}, // no rule sends requests there
+	}}
+	mapping := store.NewMemoryUploadStore()
+	_ = mapping.Put(ctx, "p1", &store.Upload{UploadIDs: map[string]string{"secondary": "s1"}})
+
+	j := New(cfg, map[config.Endpoint]store.Store{
+		config.EndpointPrimary:   p,
+		config.EndpointSecondary: s,
+	}, 24*time.Hour, WithUploadStore(mapping))
+	rep, err := j.Sweep(ctx)
+	if err != nil {
+		t.Fatalf("Sweep: %v", err)
+	}
+	if rep.Scanned != 6 || len(rep.Aborted) != 4 {
+		t.Errorf("scanned %d, aborted %d, want 6, 4", rep.Scanned, len(rep.Aborted))
+	}
+	if got := strings.Join(p.ids(), " "); got != "photos/p2" {
+		t.Errorf("primary has %s left, want photos/p2", got)
+	}
+	if got := strings.Join(s.ids(), " "); got != "cf-logs/s3 cf-photos/s2" {
+		t.Errorf("secondary has %s left, want cf-logs/s3 cf-photos/s2", got)
+	}
+	if _, err := mapping.Get(ctx, "p1"); err == nil {
+		t.Errorf("mapping of aborted upload p1 was kept")
+	}
+}
+
+func TestSweep_SecondaryOnly(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := config.Load(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, fresh := time.Now().Add(-48*time.Hour), time.Now()
+	// the secondary's side of p1 is stale, the primary's is not
+	p := &uploadStore{pageSize: 1, uploads: []upload{
+		{"photos", "a", "p0", fresh},
+		{"photos", "a", "p1", fresh},
+	}}
+	s := &uploadStore{pageSize: 1, uploads: []upload{
+		{"cf-photos", "a", "s1", old},
+	}}
+	mapping := store.NewMemoryUploadStore()
+	_ = mapping.Put(ctx, "p0", &store.Upload{UploadIDs: map[string]string{"secondary": "s0"}})
+	_ = mapping.Put(ctx, "p1", &store.Upload{UploadIDs: map[string]string{"secondary": "s1"}})
+
+	j := New(cfg, map[config.Endpoint]store.Store{
+		config.EndpointPrimary:   p,
+		config.EndpointSecondary: s,
+	}, 24*time.Hour, WithUploadStore(mapping))
+	rep, err := j.Sweep(ctx)
+	if err != nil {
+		t.Fatalf("Sweep: %v", err)
+	}
+	if len(rep.Aborted) != 1 || rep.Aborted[0].UploadID != "s1" {
+		t.Fatalf("aborted %+v, want s1 only", rep.Aborted)
+	}
+	if _, err := mapping.Get(ctx, "p1"); err == nil {
+		t.Errorf("mapping of p1, whose secondary upload was aborted, was kept")
+	}
+	if _, err := mapping.Get(ctx, "p0"); err != nil {
+		t.Errorf("mapping of p0 was dropped: %v", err)
+	}
+}
@@ -0,0 +1,646 @@
+package s3router
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+)
+
+func (c *router) ListObjectsV2(
+	ctx context.Context,
+	in *s3.ListObjectsV2Input,
+	optFns ...func(*s3.Options),
+) (*s3.ListObjectsV2Output, error) {
+	const op = "ListObjectsV2"
+	bucket, prefix := aws.ToString(in.Bucket), aws.ToString(in.Prefix)
+	if segs := c.listSegments(op, bucket, prefix); len(segs) > 1 {
+		return c.listStitched(ctx, segs, in, optFns...)
+	}
+	rt, err := c.route(op, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return listRoute(ctx, rt, in, optFns...)
+}
+
+// listRoute lists in on the targets of rt.
+func listRoute(
+	ctx context.Context,
+	rt route,
+	in *s3.ListObjectsV2Input,
+	optFns ...func(*s3.Options),
+) (*s3.ListObjectsV2Output, error) {
+	if rt.action == config.ActMerge {
+		return mergeList(ctx, rt, in, optFns...)
+	}
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.ListObjectsV2Output, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.ListObjectsV2(ctx, &in, optFns...)
+		},
+	)
+}
+
+// encodeToken and decodeToken wrap the state of a listing the router pages
+// itself in an opaque continuation token.
+func encodeToken(prefix string, v any) string {
+	b, _ := json.Marshal(v)
+	return prefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeToken(prefix, s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil || !strings.HasPrefix(s, prefix) {
+		return fmt.Errorf("invalid continuation token %q", s)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("invalid continuation token %q: %w", s, err)
+	}
+	return nil
+}
+
+// mergeToken is the continuation token of a merged listing. An endpoint
+// whose last page was fully returned resumes from its own token; the others
+// resume after the last key returned.
+type mergeToken struct {
+	After       string                     `json:"a,omitempty"`
+	AfterPrefix bool                       `json:"p,omitempty"` // After is a common prefix
+	Tokens      map[config.Endpoint]string `json:"t,omitempty"`
+	Done        map[config.Endpoint]bool   `json:"d,omitempty"`
+}
+
+const mergeTokenPrefix = "merge:"
+
+func (m *mergeToken) encode() string { return encodeToken(mergeTokenPrefix, m) }
+
+func decodeMergeToken(s string) (*mergeToken, error) {
+	var m mergeToken
+	if err := decodeToken(mergeTokenPrefix, s, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// listEntry is a key or common prefix from one endpoint's page.
+type listEntry struct {
+	key string
+	obj *types.Object // nil for a common prefix
+	t   target
+}
+
+// mergeList lists every target and merges the pages by key. A key present on
+// several endpoints is returned once, from rt.prefer or else the newest copy.
+func mergeList(
+	ctx context.Context,
+	rt route,
+	in *s3.ListObjectsV2Input,
+	optFns ...func(*s3.Options),
+) (*s3.ListObjectsV2Output, error) {
+	tok := &mergeToken{After: aws.ToString(in.StartAfter)}
+	if in.ContinuationToken != nil {
+		var err error
+		if tok, err = decodeMergeToken(*in.ContinuationToken); err != nil {
+			return nil, err
+		}
+	}
+	maxKeys := aws.ToInt32(in.MaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	pages := make([]*s3.ListObjectsV2Output, len(rt.targets))
+	errs := make([]error, len(rt.targets))
+	var wg sync.WaitGroup
+	for i, t := range rt.targets {
+		if tok.Done[t.name] {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			in.ContinuationToken, in.StartAfter = nil, nil
+			if ct, ok := tok.Tokens[t.name]; ok {
+				in.ContinuationToken = aws.String(ct)
+			} else if tok.After != "" {
+				in.StartAfter = aws.String(tok.After)
+			}
+			pages[i], errs[i] = t.st.ListObjectsV2(ctx, &in, optFns...)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rt.targets[i].name, err)
+		}
+	}
+
+	// Past the end of a truncated page, that endpoint may still have keys
+	// we have not seen, so nothing beyond the smallest such end is returned.
+	var (
+		entries  []listEntry
+		pageLast = make([]string, len(rt.targets))
+		bound    string
+		bounded  bool
+	)
+	seen := func(k string) bool {
+		return k <= tok.After || (tok.AfterPrefix && strings.HasPrefix(k, tok.After))
+	}
+	for i, t := range rt.targets {
+		p := pages[i]
+		if p == nil {
+			continue
+		}
+		for j := range p.Contents {
+			k := aws.ToString(p.Contents[j].Key)
+			pageLast[i] = max(pageLast[i], k)
+			if !seen(k) {
+				entries = append(entries, listEntry{key: k, obj: &p.Contents[j], t: t})
+			}
+		}
+		for _, cp := range p.CommonPrefixes {
+			k := aws.ToString(cp.Prefix)
+			pageLast[i] = max(pageLast[i], k)
+			if !seen(k) {
+				entries = append(entries, listEntry{key: k, t: t})
+			}
+		}
+		if aws.ToBool(p.IsTruncated) && (!bounded || pageLast[i] < bound) {
+			bound, bounded = pageLast[i], true
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	out := &s3.ListObjectsV2Output{
+		Name:              in.Bucket,
+		Prefix:            in.Prefix,
+		Delimiter:         in.Delimiter,
+		MaxKeys:           aws.Int32(maxKeys),
+		StartAfter:        in.StartAfter,
+		ContinuationToken: in.ContinuationToken,
+		EncodingType:      in.EncodingType,
+	}
+	next := &mergeToken{After: tok.After, AfterPrefix: tok.AfterPrefix}
+	var n int32
+	for i := 0; i < len(entries) && n < maxKeys; {
+		if bounded && entries[i].key > bound {
+			break
+		}
+		// gather every endpoint's copy of this key
+		j := i + 1
+		for j < len(entries) && entries[j].key == entries[i].key {
+			j++
+		}
+		if e := pick(entries[i:j], rt.prefer); e.obj != nil {
+			out.Contents = append(out.Contents, *e.obj)
+			next.AfterPrefix = false
+		} else {
+			out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(e.key)})
+			next.AfterPrefix = true
+		}
+		next.After = entries[i].key
+		n++
+		i = j
+	}
+	out.KeyCount = aws.Int32(n)
+
+	for i, t := range rt.targets {
+		p := pages[i]
+		switch {
+		case tok.Done[t.name]:
+			next.setDone(t.name)
+		case pageLast[i] > next.After:
+			// resume after next.After
+		case aws.ToBool(p.IsTruncated):
+			if next.Tokens == nil {
+				next.Tokens = make(map[config.Endpoint]string)
+			}
+			next.Tokens[t.name] = aws.ToString(p.NextContinuationToken)
+		default:
+			next.setDone(t.name)
+		}
+	}
+	if len(next.Done) < len(rt.targets) {
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(next.encode())
+	} else {
+		out.IsTruncated = aws.Bool(false)
+	}
+	return out, nil
+}
+
+func (m *mergeToken) setDone(ep config.Endpoint) {
+	if m.Done == nil {
+		m.Done = make(map[config.Endpoint]bool)
+	}
+	m.Done[ep] = true
+}
+
+// pick chooses one of several endpoints' entries for the same key: the
+// preferred endpoint's if present, else the most recently modified object.
+// Common prefixes are interchangeable.
+func pick(entries []listEntry, prefer config.Endpoint) listEntry {
+	best := entries[0]
+	for _, e := range entries[1:] {
+		switch {
+		case best.obj == nil || e.obj == nil:
+		case prefer != "":
+			if e.t.name == prefer {
+				best = e
+			}
+		case aws.ToTime(e.obj.LastModified).After(aws.ToTime(best.obj.LastModified)):
+			best = e
+		}
+	}
+	return best
+}
+
+// listSegment is a key range of a listing that a single rule routes. Keys
+// from lo (inclusive) to hi (exclusive, "" for unbounded) belong to it.
+type listSegment struct {
+	lo, hi string
+	owner  string // prefix of the rule routing the range
+}
+
+// listSegments splits a listing of prefix into ranges by the rules routing
+// them, in key order. A prefix no other rule extends is a single segment.
+func (c *router) listSegments(op, bucket, prefix string) []listSegment {
+	subs := c.cfg.SubPrefixes(bucket, prefix)
+	if len(subs) == 0 {
+		return nil
+	}
+	// The keys under sub lie in [sub, sub+maxRune); every range between
+	// consecutive bounds is routed by the longest prefix containing it.
+	end := func(p string) string { return p + string(utf8.MaxRune) }
+	bounds := []string{prefix}
+	for _, sub := range subs {
+		bounds = append(bounds, sub, end(sub))
+	}
+	sort.Strings(bounds)
+	bounds = slices.Compact(bounds)
+	segs := make([]listSegment, len(bounds))
+	for i, lo := range bounds {
+		segs[i] = listSegment{lo: lo, owner: prefix}
+		if i+1 < len(bounds) {
+			segs[i].hi = bounds[i+1]
+		}
+		for _, sub := range subs {
+			if lo >= sub && segs[i].hi != "" && segs[i].hi <= end(sub) && len(sub) > len(segs[i].owner) {
+				segs[i].owner = sub
+			}
+		}
+	}
+	return segs
+}
+
+// contains reports whether a listing entry falls in s. A common prefix that
+// covers the owning prefix is listed by whichever segment reaches it first.
+func (s listSegment) contains(key string, isPrefix bool) bool {
+	if isPrefix && key != s.owner && strings.HasPrefix(s.owner, key) {
+		return true
+	}
+	return key >= s.lo && (s.hi == "" || key < s.hi)
+}
+
+// splitToken is the continuation token of a stitched listing.
+type splitToken struct {
+	Seg         int    `json:"s"`
+	After       string `json:"a,omitempty"`
+	AfterPrefix bool   `json:"p,omitempty"` // After is a common prefix
+}
+
+const splitTokenPrefix = "split:"
+
+// listStitched lists each segment from the endpoints its rule routes to and
+// concatenates the results. Pages are requested with StartAfter, so the
+// continuation token only records the segment and the last entry returned.
+func (c *router) listStitched(
+	ctx context.Context,
+	segs []listSegment,
+	in *s3.ListObjectsV2Input,
+	optFns ...func(*s3.Options),
+) (*s3.ListObjectsV2Output, error) {
+	const op = "ListObjectsV2"
+	bucket := aws.ToString(in.Bucket)
+	tok := splitToken{After: aws.ToString(in.StartAfter)}
+	if in.ContinuationToken != nil {
+		if err := decodeToken(splitTokenPrefix, *in.ContinuationToken, &tok); err != nil {
+			return nil, err
+		}
+	}
+	maxKeys := aws.ToInt32(in.MaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	out := &s3.ListObjectsV2Output{
+		Name:              in.Bucket,
+		Prefix:            in.Prefix,
+		Delimiter:         in.Delimiter,
+		MaxKeys:           aws.Int32(maxKeys),
+		StartAfter:        in.StartAfter,
+		ContinuationToken: in.ContinuationToken,
+		EncodingType:      in.EncodingType,
+	}
+	seen := func(k string) bool {
+		return k <= tok.After || (tok.AfterPrefix && strings.HasPrefix(k, tok.After))
+	}
+
+	var n int32
+	from := "" // how far the current segment has been read
+	for tok.Seg < len(segs) && n < maxKeys {
+		seg := segs[tok.Seg]
+		if seg.hi != "" && (seg.hi <= tok.After || tok.AfterPrefix && strings.HasPrefix(seg.hi, tok.After)) {
+			tok.Seg, from = tok.Seg+1, ""
+			continue
+		}
+		rt, err := c.route(op, bucket, seg.owner)
+		if err != nil {
+			return nil, err
+		}
+		// Start just before seg.lo at the earliest; anything below it is
+		// skipped below, and from moves past it page by page.
+		_, size := utf8.DecodeLastRuneInString(seg.lo)
+		start := max(tok.After, from, seg.lo[:len(seg.lo)-size])
+		req := *in
+		req.ContinuationToken, req.StartAfter = nil, nil
+		if start != "" {
+			req.StartAfter = aws.String(start)
+		}
+		req.MaxKeys = aws.Int32(maxKeys - n + 1) // room for a repeated common prefix
+		page, err := listRoute(ctx, rt, &req, optFns...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", seg.owner, err)
+		}
+
+		entries := make([]listEntry, 0, len(page.Contents)+len(page.CommonPrefixes))
+		for i := range page.Contents {
+			entries = append(entries, listEntry{key: aws.ToString(page.Contents[i].Key), obj: &page.Contents[i]})
+		}
+		for _, cp := range page.CommonPrefixes {
+			entries = append(entries, listEntry{key: aws.ToString(cp.Prefix)})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+		segDone := !aws.ToBool(page.IsTruncated)
+		read := from
+		for _, e := range entries {
+			if e.obj != nil {
+				from = max(from, e.key)
+			} else {
+				// StartAfter a common prefix would list it again
+				from = max(from, e.key+string(utf8.MaxRune))
+			}
+			if seen(e.key) {
+				continue
+			}
+			if !seg.contains(e.key, e.obj == nil) {
+				if seg.hi != "" && e.key >= seg.hi {
+					segDone = true
+					break
+				}
+				continue
+			}
+			if e.obj != nil {
+				out.Contents = append(out.Contents, *e.obj)
+			} else {
+				out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(e.key)})
+			}
+			tok.After, tok.AfterPrefix = e.key, e.obj == nil
+			if n++; n == maxKeys {
+				break
+			}
+		}
+		if segDone && n < maxKeys {
+			tok.Seg, from = tok.Seg+1, ""
+		} else if n < maxKeys && from == read {
+			return nil, fmt.Errorf("%s: listing made no progress after %q", seg.owner, start)
+		}
+	}
+	out.KeyCount = aws.Int32(n)
+	out.IsTruncated = aws.Bool(tok.Seg < len(segs))
+	if tok.Seg < len(segs) {
+		out.NextContinuationToken = aws.String(encodeToken(splitTokenPrefix, tok))
+	}
+	return out, nil
+}
+
+// ListMultipartUploads lists the uploads in progress on the endpoints the
+// rules for the prefix read from. When there are several, every one is
+// listed and the pages are merged by key and initiation time. Each upload
+// is listed with its own endpoint's upload ID, so a mirrored upload shows
+// up once per endpoint, and so does one left behind on a single endpoint.
+func (c *router) ListMultipartUploads(
+	ctx context.Context,
+	in *s3.ListMultipartUploadsInput,
+	optFns ...func(*s3.Options),
+) (*s3.ListMultipartUploadsOutput, error) {
+	const op = "ListMultipartUploads"
+	rt, err := c.route(op, aws.ToString(in.Bucket), aws.ToString(in.Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if targets := readTargets(rt); len(targets) > 1 {
+		return mergeUploads(ctx, targets, in, optFns...)
+	}
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.ListMultipartUploadsOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.ListMultipartUploads(ctx, &in, optFns...)
+		},
+	)
+}
+
+// uploadsToken is the UploadIdMarker of a merged upload listing. Each
+// endpoint resumes from its own markers, or is done.
+type uploadsToken struct {
+	Keys map[config.Endpoint]string `json:"k,omitempty"`
+	IDs  map[config.Endpoint]string `json:"u,omitempty"`
+	Done map[config.Endpoint]bool   `json:"d,omitempty"`
+}
+
+const uploadsTokenPrefix = "uploads:"
+
+// uploadEntry is an upload or common prefix from one endpoint's page.
+type uploadEntry struct {
+	key    string
+	upload *types.MultipartUpload // nil for a common prefix
+	i      int                    // index of the target listed
+}
+
+// mergeUploads lists the uploads on every target and merges the pages.
+func mergeUploads(
+	ctx context.Context,
+	targets []target,
+	in *s3.ListMultipartUploadsInput,
+	optFns ...func(*s3.Options),
+) (*s3.ListMultipartUploadsOutput, error) {
+	var tok uploadsToken
+	if m := aws.ToString(in.UploadIdMarker); strings.HasPrefix(m, uploadsTokenPrefix) {
+		if err := decodeToken(uploadsTokenPrefix, m, &tok); err != nil {
+			return nil, err
+		}
+	} else {
+		tok.Keys = make(map[config.Endpoint]string)
+		tok.IDs = make(map[config.Endpoint]string)
+		for _, t := range targets {
+			tok.Keys[t.name], tok.IDs[t.name] = aws.ToString(in.KeyMarker), m
+		}
+	}
+	maxUploads := aws.ToInt32(in.MaxUploads)
+	if maxUploads <= 0 {
+		maxUploads = 1000
+	}
+
+	pages := make([]*s3.ListMultipartUploadsOutput, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		if tok.Done[t.name] {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			in.KeyMarker, in.UploadIdMarker = nil, nil
+			if k := tok.Keys[t.name]; k != "" {
+				in.KeyMarker = aws.String(k)
+			}
+			if id := tok.IDs[t.name]; id != "" {
+				in.UploadIdMarker = aws.String(id)
+			}
+			pages[i], errs[i] = t.st.ListMultipartUploads(ctx, &in, optFns...)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", targets[i].name, err)
+		}
+	}
+
+	// As in mergeList, nothing past the end of a truncated page is
+	// returned until that endpoint's next page has been seen.
+	var (
+		entries []uploadEntry
+		counts  = make([]int, len(targets))
+		bound   string
+		bounded bool
+	)
+	for i, p := range pages {
+		if p == nil {
+			continue
+		}
+		last := ""
+		for j := range p.Uploads {
+			k := aws.ToString(p.Uploads[j].Key)
+			entries = append(entries, uploadEntry{key: k, upload: &p.Uploads[j], i: i})
+			last = max(last, k)
+		}
+		for _, cp := range p.CommonPrefixes {
+			k := aws.ToString(cp.Prefix)
+			entries = append(entries, uploadEntry{key: k, i: i})
+			last = max(last, k)
+		}
+		counts[i] = len(p.Uploads) + len(p.CommonPrefixes)
+		if aws.ToBool(p.IsTruncated) && (!bounded || last < bound) {
+			bound, bounded = last, true
+		}
+	}
+	initiated := func(e uploadEntry) time.Time {
+		if e.upload == nil {
+			return time.Time{}
+		}
+		return aws.ToTime(e.upload.Initiated)
+	}
+	sort.SliceStable(entries, func(a, b int) bool {
+		ea, eb := entries[a], entries[b]
+		if ea.key != eb.key {
+			return ea.key < eb.key
+		}
+		if ta, tb := initiated(ea), initiated(eb); !ta.Equal(tb) {
+			return ta.Before(tb)
+		}
+		return ea.i < eb.i
+	})
+
+	out := &s3.ListMultipartUploadsOutput{
+		Bucket:         in.Bucket,
+		Prefix:         in.Prefix,
+		Delimiter:      in.Delimiter,
+		KeyMarker:      in.KeyMarker,
+		UploadIdMarker: in.UploadIdMarker,
+		MaxUploads:     aws.Int32(maxUploads),
+		EncodingType:   in.EncodingType,
+	}
+	taken := make([]int, len(targets))
+	last := make([]*uploadEntry, len(targets))
+	var n int32
+	for k := 0; k < len(entries) && n < maxUploads; n++ {
+		e := entries[k]
+		if bounded && e.key > bound {
+			break
+		}
+		if e.upload != nil {
+			out.Uploads = append(out.Uploads, *e.upload)
+			taken[e.i]++
+			last[e.i] = &entries[k]
+			k++
+		} else {
+			// the same common prefix from every endpoint is returned once
+			for ; k < len(entries) && entries[k].key == e.key && entries[k].upload == nil; k++ {
+				taken[entries[k].i]++
+				last[entries[k].i] = &entries[k]
+			}
+			out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(e.key)})
+		}
+		out.NextKeyMarker = aws.String(e.key)
+	}
+
+	next := uploadsToken{
+		Keys: make(map[config.Endpoint]string),
+		IDs:  make(map[config.Endpoint]string),
+		Done: make(map[config.Endpoint]bool),
+	}
+	for i, t := range targets {
+		p := pages[i]
+		switch {
+		case tok.Done[t.name]:
+			next.Done[t.name] = true
+		case taken[i] == counts[i] && !aws.ToBool(p.IsTruncated):
+			next.Done[t.name] = true
+		case taken[i] == counts[i]:
+			next.Keys[t.name] = aws.ToString(p.NextKeyMarker)
+			next.IDs[t.name] = aws.ToString(p.NextUploadIdMarker)
+		case last[i] == nil:
+			next.Keys[t.name], next.IDs[t.name] = tok.Keys[t.name], tok.IDs[t.name]
+		case last[i].upload == nil:
+			// a key marker equal to a common prefix would list it again
+			next.Keys[t.name] = last[i].key + string(utf8.MaxRune)
+		default:
+			next.Keys[t.name] = last[i].key
+			next.IDs[t.name] = aws.ToString(last[i].upload.UploadId)
+		}
+	}
+	out.IsTruncated = aws.Bool(len(next.Done) < len(targets))
+	if aws.ToBool(out.IsTruncated) {
+		out.NextUploadIdMarker = aws.String(encodeToken(uploadsTokenPrefix, next))
+	}
+	return out, nil
+}
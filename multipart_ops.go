@@ -2,103 +2,363 @@ package s3router
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/replicate"
 	"github.com/wilbeibi/s3router/store"
 )
 
+// CreateMultipartUpload opens the upload on every target under mirror,
+// best-effort and quorum. The caller only ever sees the leading target's
+// upload ID; the other targets' upload IDs and part ETags are kept in
+// c.uploads and substituted on every later call.
 func (c *router) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
 	const op = "CreateMultipartUpload"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
-			return st.CreateMultipartUpload(ctx, in, optFns...)
-		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
-	)
+	create := func(ctx context.Context, t target) (*s3.CreateMultipartUploadOutput, error) {
+		in := *in
+		in.Bucket = aws.String(t.bucket)
+		return t.st.CreateMultipartUpload(ctx, &in, optFns...)
+	}
+	switch rt.action {
+	case config.ActMirror, config.ActBestEffort, config.ActQuorum:
+	default:
+		return dispatch(ctx, rt, create)
+	}
+
+	// All uploads must exist before any part is sent, so even best-effort
+	// and quorum wait for every target here.
+	var wg sync.WaitGroup
+	outs := make([]*s3.CreateMultipartUploadOutput, len(rt.targets))
+	errs := make([]error, len(rt.targets))
+	wg.Add(len(rt.targets))
+	for i, t := range rt.targets {
+		go func() {
+			defer wg.Done()
+			outs[i], errs[i] = create(ctx, t)
+		}()
+	}
+	wg.Wait()
+
+	// The first target that opened the upload leads.
+	lead := -1
+	qerr := &QuorumError{Need: rt.acks}
+	for i, t := range rt.targets {
+		if errs[i] != nil {
+			qerr.Failed = append(qerr.Failed, EndpointError{Endpoint: t.name, Err: errs[i]})
+			continue
+		}
+		qerr.Acked++
+		if lead < 0 {
+			lead = i
+		}
+	}
+	var failed error
+	switch {
+	case rt.action == config.ActMirror && len(qerr.Failed) > 0:
+		failed = qerr.Failed[0].Err
+	case rt.action == config.ActBestEffort && errs[0] != nil:
+		failed = errs[0]
+	case rt.action == config.ActQuorum && qerr.Acked < rt.acks:
+		failed = qerr
+	}
+	abortAll := func() {
+		for i, t := range rt.targets {
+			if errs[i] == nil {
+				abortUpload(ctx, t, key, outs[i].UploadId)
+			}
+		}
+	}
+	if failed != nil {
+		abortAll()
+		return nil, failed
+	}
+
+	// Targets that failed here are left out; their later calls fail too.
+	u := &store.Upload{UploadIDs: make(map[string]string)}
+	for i, t := range rt.targets {
+		if errs[i] == nil && i != lead {
+			u.UploadIDs[string(t.name)] = aws.ToString(outs[i].UploadId)
+		}
+	}
+	if len(u.UploadIDs) == 0 {
+		return outs[lead], nil
+	}
+	if err := c.uploads.Put(ctx, aws.ToString(outs[lead].UploadId), u); err != nil {
+		abortAll()
+		return nil, fmt.Errorf("%s: failed to record upload mapping: %w", op, err)
+	}
+	return outs[lead], nil
 }
 
 func (c *router) UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
 	const op = "UploadPart"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	u, err := c.lookupUpload(ctx, in.UploadId)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	check := checkMirror(rt, in.ChecksumAlgorithm)
+	body := in.Body
+	if check != nil {
+		body = check.body(body)
+	}
+	rt.bodies, err = c.targetBodies(ctx, rt, body, in.ContentLength)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	uploadID := aws.ToString(in.UploadId)
+	out, err := dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.UploadPartOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			id, mapped := mappedID(u, t)
+			if mapped {
+				in.UploadId = aws.String(id)
+			}
+			if rt.bodies != nil {
+				in.Body = rt.bodies[t.i]
+			}
+			if check != nil {
+				in.ChecksumAlgorithm = check.algo
+			}
+			out, err := t.st.UploadPart(ctx, &in, optFns...)
+			if err == nil && check != nil {
+				check.record(t.i, out.ETag, out.ChecksumCRC32, out.ChecksumCRC32C, out.ChecksumSHA1, out.ChecksumSHA256)
+			}
+			if err == nil && mapped {
+				err = c.uploads.PutPart(ctx, uploadID, string(t.name), aws.ToInt32(in.PartNumber), aws.ToString(out.ETag))
+			}
+			return out, err
+		},
+	)
+	if err == nil && check != nil {
+		if err = c.verify(ctx, rt, check, bucket, key); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return out, err
+}
+
+// UploadPartCopy copies a part server-side on every target the source is
+// read from too. Other targets get the byte range fetched from the source
+// and uploaded as a regular part. The source is read as CopyObject reads
+// it.
+func (c *router) UploadPartCopy(ctx context.Context, in *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	const op = "UploadPartCopy"
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	src, err := c.copySources(aws.ToString(in.CopySource))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
-			return st.UploadPart(ctx, in, optFns...)
+	u, err := c.lookupUpload(ctx, in.UploadId)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	uploadID := aws.ToString(in.UploadId)
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.UploadPartCopyOutput, error) {
+			id, mapped := mappedID(u, t)
+			if !mapped {
+				id = uploadID
+			}
+			out, err := fromSource(ctx, src, t, func(s target) (*s3.UploadPartCopyOutput, error) {
+				if s.name != t.name {
+					return copyPartAcross(ctx, src, s, t, id, in, optFns...)
+				}
+				in := *in
+				in.Bucket = aws.String(t.bucket)
+				in.UploadId = aws.String(id)
+				in.CopySource = aws.String(copySource(s.bucket, src.key, src.versionID))
+				out, err := t.st.UploadPartCopy(ctx, &in, optFns...)
+				if err != nil {
+					return nil, &sourceError{err}
+				}
+				return out, nil
+			})
+			if err == nil && mapped {
+				err = c.uploads.PutPart(ctx, uploadID, string(t.name), aws.ToInt32(in.PartNumber), aws.ToString(out.CopyPartResult.ETag))
+			}
+			return out, err
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
 }
 
+// copyPartAcross fetches the source range of a part copy from src and
+// uploads it to dst as a regular part of uploadID.
+func copyPartAcross(
+	ctx context.Context,
+	from copySrc,
+	src target,
+	dst target,
+	uploadID string,
+	in *s3.UploadPartCopyInput,
+	optFns ...func(*s3.Options),
+) (*s3.UploadPartCopyOutput, error) {
+	obj, err := src.st.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:            aws.String(src.bucket),
+		Key:               aws.String(from.key),
+		VersionId:         from.versionID,
+		Range:             in.CopySourceRange,
+		IfMatch:           in.CopySourceIfMatch,
+		IfNoneMatch:       in.CopySourceIfNoneMatch,
+		IfModifiedSince:   in.CopySourceIfModifiedSince,
+		IfUnmodifiedSince: in.CopySourceIfUnmodifiedSince,
+	}, optFns...)
+	if err != nil {
+		return nil, &sourceError{err}
+	}
+	defer obj.Body.Close()
+	part, err := dst.st.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(dst.bucket),
+		Key:           in.Key,
+		UploadId:      aws.String(uploadID),
+		PartNumber:    in.PartNumber,
+		Body:          obj.Body,
+		ContentLength: obj.ContentLength,
+	}, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartCopyOutput{
+		CopyPartResult: &types.CopyPartResult{ETag: part.ETag, LastModified: obj.LastModified},
+	}, nil
+}
+
 func (c *router) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
 	const op = "CompleteMultipartUpload"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
-			return st.CompleteMultipartUpload(ctx, in, optFns...)
+	c.journal(&rt, replicate.KindCopy, bucket, key)
+	c.rollbackWrite(&rt, key)
+	u, err := c.lookupUpload(ctx, in.UploadId)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	out, err := dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.CompleteMultipartUploadOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			id, mapped := mappedID(u, t)
+			if mapped {
+				in.UploadId = aws.String(id)
+				if in.MultipartUpload != nil {
+					parts := make([]types.CompletedPart, len(in.MultipartUpload.Parts))
+					for i, p := range in.MultipartUpload.Parts {
+						etag, ok := u.ETags[string(t.name)][aws.ToInt32(p.PartNumber)]
+						if !ok {
+							return nil, fmt.Errorf("%s: part %d was not uploaded to %s", op, aws.ToInt32(p.PartNumber), t.name)
+						}
+						p.ETag = aws.String(etag)
+						parts[i] = p
+					}
+					in.MultipartUpload = &types.CompletedMultipartUpload{Parts: parts}
+				}
+			}
+			return t.st.CompleteMultipartUpload(ctx, &in, optFns...)
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
+	if err == nil && u != nil {
+		_ = c.uploads.Delete(ctx, aws.ToString(in.UploadId))
+	}
+	return out, err
 }
 
 func (c *router) ListParts(ctx context.Context, in *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
 	const op = "ListParts"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.ListPartsInput) (*s3.ListPartsOutput, error) {
-			return st.ListParts(ctx, in)
+	u, err := c.lookupUpload(ctx, in.UploadId)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.ListPartsOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			if id, ok := mappedID(u, t); ok {
+				in.UploadId = aws.String(id)
+			}
+			return t.st.ListParts(ctx, &in, optFns...)
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
 }
 
 func (c *router) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
 	const op = "AbortMultipartUpload"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
-			return st.AbortMultipartUpload(ctx, in, optFns...)
+	u, err := c.lookupUpload(ctx, in.UploadId)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	out, err := dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.AbortMultipartUploadOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			if id, ok := mappedID(u, t); ok {
+				in.UploadId = aws.String(id)
+			}
+			return t.st.AbortMultipartUpload(ctx, &in, optFns...)
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
+	if err == nil && u != nil {
+		_ = c.uploads.Delete(ctx, aws.ToString(in.UploadId))
+	}
+	return out, err
+}
+
+// lookupUpload returns the mapping for uploadID, or nil if the upload was
+// only opened on a single endpoint.
+func (c *router) lookupUpload(ctx context.Context, uploadID *string) (*store.Upload, error) {
+	u, err := c.uploads.Get(ctx, aws.ToString(uploadID))
+	if errors.Is(err, store.ErrUploadNotFound) {
+		return nil, nil
+	}
+	return u, err
+}
+
+// mappedID returns t's own upload ID if the upload u is mapped for it.
+func mappedID(u *store.Upload, t target) (string, bool) {
+	if u == nil {
+		return "", false
+	}
+	id, ok := u.UploadIDs[string(t.name)]
+	return id, ok
+}
+
+// abortUpload aborts a half-created mirrored upload, ignoring errors.
+func abortUpload(ctx context.Context, t target, key string, uploadID *string) {
+	_, _ = t.st.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(t.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
 }
@@ -0,0 +1,247 @@
+package s3router
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+)
+
+func mustLoad(t *testing.T, yml string) *config.Config {
+	t.Helper()
+	cfg, err := config.Load(strings.NewReader(yml))
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	return cfg
+}
+
+const mirrorYAML = `
+buckets:
+  photos:
+    primary: photos
+    secondary: cf-photos
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": mirror
+`
+
+func TestMultipart_MirrorMapsUploadIDs(t *testing.T) {
+	ctx := context.Background()
+	p, s := newMemStore("p"), newMemStore("s")
+	r, _ := New(mustLoad(t, mirrorYAML), p, s)
+
+	created, err := r.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String("photos"), Key: aws.String("big.bin"),
+	})
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload: %v", err)
+	}
+
+	var parts []types.CompletedPart
+	for i, chunk := range []string{"hello, ", "world"} {
+		n := int32(i + 1)
+		out, err := r.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String("photos"),
+			Key:           aws.String("big.bin"),
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int32(n),
+			Body:          bytes.NewReader([]byte(chunk)),
+			ContentLength: aws.Int64(int64(len(chunk))),
+		})
+		if err != nil {
+			t.Fatalf("UploadPart %d: %v", n, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(n)})
+	}
+
+	_, err = r.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("photos"),
+		Key:             aws.String("big.bin"),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		t.Fatalf("CompleteMultipartUpload: %v", err)
+	}
+
+	for _, tc := range []struct {
+		st     *memStore
+		bucket string
+	}{{p, "photos"}, {s, "cf-photos"}} {
+		got, ok := tc.st.object(tc.bucket, "big.bin")
+		if !ok || string(got) != "hello, world" {
+			t.Errorf("%s: got %q (exists=%v)", tc.st.name, got, ok)
+		}
+	}
+}
+
+func TestUploadPartCopy_AcrossEndpoints(t *testing.T) {
+	ctx := context.Background()
+	// the upload is mirrored, the source on one endpoint only
+	for _, tc := range []struct {
+		name, source string
+		pCopy, sCopy int // server-side part copies on each endpoint
+	}{
+		{"source on the primary", "a/x", 2, 0},
+		{"fallback source on the secondary", "f/x", 0, 2},
+	} {
+		p, s := newMemStore("p"), newMemStore("s")
+		if tc.source == "a/x" {
+			p.objects["photos/a/x"] = []byte("0123456789")
+		} else {
+			s.objects["cf-photos/f/x"] = []byte("0123456789")
+		}
+		r, _ := New(mustLoad(t, splitYAML), p, s)
+
+		created, err := r.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String("photos"), Key: aws.String("m/big.bin"),
+		})
+		if err != nil {
+			t.Fatalf("%s: CreateMultipartUpload: %v", tc.name, err)
+		}
+		var parts []types.CompletedPart
+		for i, rng := range []string{"bytes=0-3", "bytes=4-9"} {
+			n := int32(i + 1)
+			out, err := r.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:          aws.String("photos"),
+				Key:             aws.String("m/big.bin"),
+				UploadId:        created.UploadId,
+				PartNumber:      aws.Int32(n),
+				CopySource:      aws.String("photos/" + tc.source),
+				CopySourceRange: aws.String(rng),
+			})
+			if err != nil {
+				t.Fatalf("%s: UploadPartCopy %d: %v", tc.name, n, err)
+			}
+			parts = append(parts, types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int32(n)})
+		}
+		_, err = r.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String("photos"),
+			Key:             aws.String("m/big.bin"),
+			UploadId:        created.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		if err != nil {
+			t.Fatalf("%s: CompleteMultipartUpload: %v", tc.name, err)
+		}
+
+		if p.copies != tc.pCopy || s.copies != tc.sCopy {
+			t.Errorf("%s: server-side part copies = %d, %d, want %d, %d", tc.name, p.copies, s.copies, tc.pCopy, tc.sCopy)
+		}
+		for _, c := range []struct {
+			st     *memStore
+			bucket string
+		}{{p, "photos"}, {s, "cf-photos"}} {
+			got, ok := c.st.object(c.bucket, "m/big.bin")
+			if !ok || string(got) != "0123456789" {
+				t.Errorf("%s: %s: got %q (exists=%v)", tc.name, c.st.name, got, ok)
+			}
+		}
+	}
+}
+
+func TestMultipart_BestEffortCopiesParts(t *testing.T) {
+	ctx := context.Background()
+	p, s := newMemStore("p"), newMemStore("s")
+	r, _ := New(mustLoad(t, strings.Replace(mirrorYAML, "mirror", "best-effort", 1)), p, s)
+
+	created, err := r.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String("photos"), Key: aws.String("big.bin"),
+	})
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload: %v", err)
+	}
+	_, err = r.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String("photos"),
+		Key:           aws.String("big.bin"),
+		UploadId:      created.UploadId,
+		PartNumber:    aws.Int32(1),
+		Body:          bytes.NewReader([]byte("hello")),
+		ContentLength: aws.Int64(5),
+	})
+	if err != nil {
+		t.Fatalf("UploadPart: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		got, ok := s.uploads["s-0"][1]
+		s.mu.Unlock()
+		if ok {
+			if string(got) != "hello" {
+				t.Fatalf("secondary part = %q", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("part was not uploaded to the secondary")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListMultipartUploads_Merged(t *testing.T) {
+	ctx := context.Background()
+	p, s := newMemStore("p"), newMemStore("s")
+	r, _ := New(mustLoad(t, mirrorYAML), p, s)
+	for _, key := range []string{"a", "c"} {
+		if _, err := r.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String("photos"), Key: aws.String(key),
+		}); err != nil {
+			t.Fatalf("CreateMultipartUpload(%s): %v", key, err)
+		}
+	}
+	// left behind on one endpoint only
+	if _, err := s.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String("cf-photos"), Key: aws.String("b"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"a/p-0": true, "a/s-0": true, "b/s-2": true, "c/p-1": true, "c/s-1": true}
+
+	for _, pageSize := range []int32{1, 2, 1000} {
+		in := &s3.ListMultipartUploadsInput{Bucket: aws.String("photos"), MaxUploads: aws.Int32(pageSize)}
+		got := make(map[string]bool)
+		prev := ""
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatalf("page size %d: listing does not end", pageSize)
+			}
+			out, err := r.ListMultipartUploads(ctx, in)
+			if err != nil {
+				t.Fatalf("page size %d: ListMultipartUploads: %v", pageSize, err)
+			}
+			if int32(len(out.Uploads)) > pageSize {
+				t.Errorf("page size %d: got %d uploads", pageSize, len(out.Uploads))
+			}
+			for _, u := range out.Uploads {
+				id := aws.ToString(u.Key) + "/" + aws.ToString(u.UploadId)
+				if got[id] || aws.ToString(u.Key) < prev {
+					t.Errorf("page size %d: %s listed out of order or twice", pageSize, id)
+				}
+				got[id], prev = true, aws.ToString(u.Key)
+			}
+			if !aws.ToBool(out.IsTruncated) {
+				break
+			}
+			in.KeyMarker, in.UploadIdMarker = out.NextKeyMarker, out.NextUploadIdMarker
+		}
+		if len(got) != len(want) {
+			t.Errorf("page size %d: listed %v, want %v", pageSize, got, want)
+		}
+		for id := range want {
+			if !got[id] {
+				t.Errorf("page size %d: %s not listed", pageSize, id)
+			}
+		}
+	}
+}
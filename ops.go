@@ -2,23 +2,18 @@ package s3router
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/replicate"
 	"github.com/wilbeibi/s3router/store"
 )
 
-func (c *router) routeAction(op, bucket, key string) (config.Action, error) {
-	if !c.cfg.IsLogicalBucket(bucket) {
-		return "", fmt.Errorf("%s: bucket %q is not configured", op, bucket)
-	}
-	_, action := c.cfg.Lookup(bucket, key, op)
-	return action, nil
-}
-
 func (c *router) GetObject(
 	ctx context.Context,
 	in *s3.GetObjectInput,
@@ -26,20 +21,95 @@ func (c *router) GetObject(
 ) (*s3.GetObjectOutput, error) {
 	const op = "GetObject"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-			return st.GetObject(ctx, in, optFns...)
-		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
-	)
+	get := func(ctx context.Context, t target) (*s3.GetObjectOutput, error) {
+		in := *in
+		in.Bucket = aws.String(t.bucket)
+		return t.st.GetObject(ctx, &in, optFns...)
+	}
+	if (rt.action == config.ActMigrateOnRead || rt.repair != "") && in.VersionId == nil {
+		return readRepaired(ctx, c, rt, bucket, key, get)
+	}
+	return dispatch(ctx, rt, get)
+}
+
+// Divergence is an object a fallback read found missing on the first
+// endpoint of its rule but present on a later one.
+type Divergence struct {
+	Bucket  string
+	Key     string
+	Missing config.Endpoint
+	Found   config.Endpoint
+	Copied  bool // a copy back to Missing was started
+}
+
+// WithReadRepairReport sets a function called with every divergence found
+// by a fallback rule with repair set to either mode.
+func WithReadRepairReport(fn func(context.Context, Divergence)) Option {
+	return func(c *router) {
+		c.onDivergence = fn
+	}
+}
+
+// readRepaired serves a read like fallback. When the first target does not
+// have the object, the target that served it copies it there in the
+// background, or the divergence is only reported, as the rule says. A
+// missing bucket or version is not a divergence.
+func readRepaired[T any](
+	ctx context.Context,
+	c *router,
+	rt route,
+	bucket, key string,
+	read func(context.Context, target) (T, error),
+) (T, error) {
+	read = guarded(read)
+	dest := rt.targets[0]
+	out, err := read(ctx, dest)
+	if err == nil || !failsOver(ctx, err, rt.failover) {
+		return out, err
+	}
+	missing := store.IsNoSuchKey(err)
+	for _, t := range rt.targets[1:] {
+		out, err = read(ctx, t)
+		if err != nil {
+			if failsOver(ctx, err, rt.failover) {
+				continue
+			}
+			return out, err
+		}
+		if missing {
+			copied := rt.repair != config.RepairReport
+			if copied {
+				c.migrate(ctx, t, dest, key)
+			}
+			if rt.repair != "" && c.onDivergence != nil {
+				c.onDivergence(ctx, Divergence{Bucket: bucket, Key: key, Missing: dest.name, Found: t.name, Copied: copied})
+			}
+		}
+		return out, nil
+	}
+	return out, err
+}
+
+// migrate copies key from src to dest in the background, once at a time per
+// key. The copy only creates the object, so a write that lands on dest in
+// the meantime is never overwritten.
+func (c *router) migrate(ctx context.Context, src, dest target, key string) {
+	id := string(dest.name) + "/" + dest.bucket + "/" + key
+	if _, busy := c.migrating.LoadOrStore(id, struct{}{}); busy {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer c.migrating.Delete(id)
+		_ = store.CopyObject(ctx, src.st, src.bucket, dest.st, dest.bucket, key,
+			func(in *s3.PutObjectInput) {
+				in.IfNoneMatch = aws.String("*")
+			})
+	}()
 }
 
 func (c *router) PutObject(
@@ -49,37 +119,45 @@ func (c *router) PutObject(
 ) (*s3.PutObjectOutput, error) {
 	const op = "PutObject"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	if action == config.ActMirror && in.Body != nil {
-		var (
-			r1, r2 io.Reader
-			err    error
-		)
-		// If ContentLength is not provided, S3 use chunked transfer encoding.
-		if in.ContentLength == nil || *in.ContentLength >= c.maxBufferBytes {
-			r1, r2, err = teeBody(ctx, in.Body)
-		} else {
-			r1, r2, err = drainBody(ctx, in.Body)
-		}
-		if err != nil {
-			return nil, fmt.Errorf("%s: failed to split body for mirror: %w", op, err)
-		}
-		inPrimary.Body = r1
-		inSecondary.Body = r2
+	c.journal(&rt, replicate.KindCopy, bucket, key)
+	c.rollbackWrite(&rt, key)
+	check := checkMirror(rt, in.ChecksumAlgorithm)
+	body := in.Body
+	if check != nil {
+		body = check.body(body)
+	}
+	rt.bodies, err = c.targetBodies(ctx, rt, body, in.ContentLength)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
-			return st.PutObject(ctx, in, optFns...)
+	out, err := dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.PutObjectOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			if rt.bodies != nil {
+				in.Body = rt.bodies[t.i]
+			}
+			if check == nil {
+				return t.st.PutObject(ctx, &in, optFns...)
+			}
+			in.ChecksumAlgorithm = check.algo
+			out, err := t.st.PutObject(ctx, &in, optFns...)
+			if err == nil {
+				check.record(t.i, out.ETag, out.ChecksumCRC32, out.ChecksumCRC32C, out.ChecksumSHA1, out.ChecksumSHA256)
+			}
+			return out, err
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
+	if err == nil && check != nil {
+		if err = c.verify(ctx, rt, check, bucket, key); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return out, err
 }
 
 func (c *router) HeadObject(
@@ -89,20 +167,19 @@ func (c *router) HeadObject(
 ) (*s3.HeadObjectOutput, error) {
 	const op = "HeadObject"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
-			return st.HeadObject(ctx, in, optFns...)
-		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
-	)
+	head := func(ctx context.Context, t target) (*s3.HeadObjectOutput, error) {
+		in := *in
+		in.Bucket = aws.String(t.bucket)
+		return t.st.HeadObject(ctx, &in, optFns...)
+	}
+	if rt.repair != "" && in.VersionId == nil {
+		return readRepaired(ctx, c, rt, bucket, key, head)
+	}
+	return dispatch(ctx, rt, head)
 }
 
 func (c *router) DeleteObject(
@@ -112,60 +189,187 @@ func (c *router) DeleteObject(
 ) (*s3.DeleteObjectOutput, error) {
 	const op = "DeleteObject"
 	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
-	action, err := c.routeAction(op, bucket, key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
-			return st.DeleteObject(ctx, in, optFns...)
+	c.journal(&rt, replicate.KindDelete, bucket, key)
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.DeleteObjectOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.DeleteObject(ctx, &in, optFns...)
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
 }
 
-func (c *router) DeleteObjects(ctx context.Context, in *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
-	const op = "DeleteObjects"
-	bucket := aws.ToString(in.Bucket)
-	action, err := c.routeAction(op, bucket, "")
+func (c *router) GetObjectTagging(
+	ctx context.Context,
+	in *s3.GetObjectTaggingInput,
+	optFns ...func(*s3.Options),
+) (*s3.GetObjectTaggingOutput, error) {
+	const op = "GetObjectTagging"
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
-			return st.DeleteObjects(ctx, in, optFns...)
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.GetObjectTaggingOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.GetObjectTagging(ctx, &in, optFns...)
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
 }
 
-func (c *router) ListObjectsV2(
+// PutObjectTagging replaces an object's tags. Best-effort targets that miss
+// the change get the first target's tags later; the object is not copied.
+func (c *router) PutObjectTagging(
 	ctx context.Context,
-	in *s3.ListObjectsV2Input,
+	in *s3.PutObjectTaggingInput,
 	optFns ...func(*s3.Options),
-) (*s3.ListObjectsV2Output, error) {
-	const op = "ListObjectsV2"
+) (*s3.PutObjectTaggingOutput, error) {
+	const op = "PutObjectTagging"
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	rt, err := c.route(op, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	c.journal(&rt, replicate.KindTagging, bucket, key)
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.PutObjectTaggingOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.PutObjectTagging(ctx, &in, optFns...)
+		},
+	)
+}
+
+// DeleteObjectTagging removes an object's tags, repaired like
+// PutObjectTagging.
+func (c *router) DeleteObjectTagging(
+	ctx context.Context,
+	in *s3.DeleteObjectTaggingInput,
+	optFns ...func(*s3.Options),
+) (*s3.DeleteObjectTaggingOutput, error) {
+	const op = "DeleteObjectTagging"
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	rt, err := c.route(op, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	c.journal(&rt, replicate.KindTagging, bucket, key)
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.DeleteObjectTaggingOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.DeleteObjectTagging(ctx, &in, optFns...)
+		},
+	)
+}
+
+func (c *router) DeleteObjects(ctx context.Context, in *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	const op = "DeleteObjects"
 	bucket := aws.ToString(in.Bucket)
-	action, err := c.routeAction(op, bucket, "")
+	if !c.cfg.IsLogicalBucket(bucket) {
+		return nil, fmt.Errorf("%s: bucket %q is not configured", op, bucket)
+	}
+	if in.Delete == nil || len(in.Delete.Objects) == 0 {
+		return c.deleteObjects(ctx, op, bucket, "", in, optFns...)
+	}
+	batches := c.splitDeletes(op, bucket, in.Delete.Objects)
+	if len(batches) == 1 {
+		return c.deleteObjects(ctx, op, bucket, aws.ToString(batches[0][0].Key), in, optFns...)
+	}
+
+	// Keys under different rules go out as one request per rule. A batch
+	// that fails outright reports each of its keys as an error, unless every
+	// batch failed.
+	outs := make([]*s3.DeleteObjectsOutput, len(batches))
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	for i, objs := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			in := *in
+			del := *in.Delete
+			del.Objects = objs
+			in.Delete = &del
+			outs[i], errs[i] = c.deleteObjects(ctx, op, bucket, aws.ToString(objs[0].Key), &in, optFns...)
+		}()
+	}
+	wg.Wait()
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == len(batches) {
+		return nil, errors.Join(errs...)
+	}
+	out := &s3.DeleteObjectsOutput{}
+	for i, objs := range batches {
+		if errs[i] != nil {
+			for _, obj := range objs {
+				out.Errors = append(out.Errors, types.Error{
+					Key:       obj.Key,
+					VersionId: obj.VersionId,
+					Code:      aws.String("InternalError"),
+					Message:   aws.String(errs[i].Error()),
+				})
+			}
+			continue
+		}
+		out.Deleted = append(out.Deleted, outs[i].Deleted...)
+		out.Errors = append(out.Errors, outs[i].Errors...)
+		if out.RequestCharged == "" {
+			out.RequestCharged = outs[i].RequestCharged
+		}
+	}
+	return out, nil
+}
+
+// splitDeletes groups objs by the rule their keys fall under, in order of
+// first appearance.
+func (c *router) splitDeletes(op, bucket string, objs []types.ObjectIdentifier) [][]types.ObjectIdentifier {
+	type ruleID struct{ bucket, prefix string }
+	var batches [][]types.ObjectIdentifier
+	index := make(map[ruleID]int)
+	for _, obj := range objs {
+		rule, _ := c.cfg.Lookup(bucket, aws.ToString(obj.Key), op)
+		id := ruleID{rule.Bucket, rule.Prefix}
+		i, ok := index[id]
+		if !ok {
+			i = len(batches)
+			index[id] = i
+			batches = append(batches, nil)
+		}
+		batches[i] = append(batches[i], obj)
+	}
+	return batches
+}
+
+// deleteObjects sends in, whose keys all share the rule for key.
+func (c *router) deleteObjects(ctx context.Context, op, bucket, key string, in *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	rt, err := c.route(op, bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	primB, secB := c.cfg.PhysicalBuckets(bucket)
-	inPrimary, inSecondary := *in, *in
-	inPrimary.Bucket, inSecondary.Bucket = aws.String(primB), aws.String(secB)
-	return dispatch(ctx, action,
-		func(ctx context.Context, st store.Store, in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
-			return st.ListObjectsV2(ctx, in, optFns...)
+	if in.Delete != nil {
+		keys := make([]string, 0, len(in.Delete.Objects))
+		for _, obj := range in.Delete.Objects {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+		c.journal(&rt, replicate.KindDelete, bucket, keys...)
+	}
+	return dispatch(ctx, rt,
+		func(ctx context.Context, t target) (*s3.DeleteObjectsOutput, error) {
+			in := *in
+			in.Bucket = aws.String(t.bucket)
+			return t.st.DeleteObjects(ctx, &in, optFns...)
 		},
-		&inPrimary, &inSecondary,
-		c.primary, c.secondary,
 	)
 }
@@ -0,0 +1,68 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Checkpoint persists the last key a run finished with, per logical bucket.
+type Checkpoint interface {
+	Load(ctx context.Context, bucket string) (string, error)
+	Save(ctx context.Context, bucket, key string) error
+}
+
+// FileCheckpoint keeps checkpoints for all buckets in one JSON file.
+type FileCheckpoint struct {
+	mu   sync.Mutex
+	path string
+}
+
+var _ Checkpoint = (*FileCheckpoint)(nil)
+
+func NewFileCheckpoint(path string) *FileCheckpoint {
+	return &FileCheckpoint{path: path}
+}
+
+func (c *FileCheckpoint) Load(_ context.Context, bucket string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.read()
+	return m[bucket], err
+}
+
+func (c *FileCheckpoint) Save(_ context.Context, bucket, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.read()
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		delete(m, bucket)
+	} else {
+		m[bucket] = key
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *FileCheckpoint) read() (map[string]string, error) {
+	m := make(map[string]string)
+	b, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
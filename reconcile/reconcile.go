@@ -0,0 +1,266 @@
+// Package reconcile compares the physical copies of a logical bucket on two
+// endpoints and optionally repairs the target from the source.
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/store"
+)
+
+// DiffKind classifies how a key differs between source and target.
+type DiffKind string
+
+const (
+	DiffMissing  DiffKind = "missing"  // only on the source
+	DiffExtra    DiffKind = "extra"    // only on the target
+	DiffMismatch DiffKind = "mismatch" // on both, size or ETag differ
+)
+
+// Diff is one key that differs between source and target.
+type Diff struct {
+	Key      string
+	Kind     DiffKind
+	Source   *types.Object // nil for DiffExtra
+	Target   *types.Object // nil for DiffMissing
+	Repaired bool
+	Err      error // repair error, if any
+}
+
+// Report summarises one run over a logical bucket.
+type Report struct {
+	Bucket  string
+	From    string // key the run resumed after, "" for a full run
+	Scanned int    // keys seen on either side
+	Diffs   []Diff
+}
+
+// Option configures a Reconciler.
+type Option func(*Reconciler)
+
+// WithDirection sets the endpoint treated as the source of truth and the
+// one that is compared against it. Defaults to primary → secondary.
+func WithDirection(source, target config.Endpoint) Option {
+	return func(r *Reconciler) {
+		r.source, r.target = source, target
+	}
+}
+
+// WithRepair copies missing and mismatched objects from source to target.
+// Extra objects on the target are only reported.
+func WithRepair() Option {
+	return func(r *Reconciler) {
+		r.repair = true
+	}
+}
+
+// WithRateLimit caps List and repair calls, on both sides together, to n
+// per second. n <= 0 means no limit.
+func WithRateLimit(n int) Option {
+	return func(r *Reconciler) {
+		r.interval = 0
+		if n > 0 {
+			r.interval = time.Second / time.Duration(n)
+		}
+	}
+}
+
+// WithCheckpoint makes runs resume after the last key saved to cp, and
+// saves progress every `every` keys.
+func WithCheckpoint(cp Checkpoint, every int) Option {
+	return func(r *Reconciler) {
+		r.checkpoint, r.every = cp, every
+	}
+}
+
+// Reconciler walks a logical bucket on two endpoints in key order.
+type Reconciler struct {
+	cfg            *config.Config
+	stores         map[config.Endpoint]store.Store
+	source, target config.Endpoint
+	repair         bool
+	interval       time.Duration
+	checkpoint     Checkpoint
+	every          int
+}
+
+func New(cfg *config.Config, stores map[config.Endpoint]store.Store, opts ...Option) *Reconciler {
+	r := &Reconciler{
+		cfg:    cfg,
+		stores: stores,
+		source: config.EndpointPrimary,
+		target: config.EndpointSecondary,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run compares the physical buckets behind the logical bucket. On error the
+// report covers the keys processed so far, and a checkpoint, if configured,
+// lets the next run pick up from there. A run that completes clears it.
+func (r *Reconciler) Run(ctx context.Context, bucket string) (*Report, error) {
+	src, dst := r.stores[r.source], r.stores[r.target]
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("reconcile: no store for %q or %q", r.source, r.target)
+	}
+	srcBucket := r.cfg.PhysicalBucket(bucket, r.source)
+	dstBucket := r.cfg.PhysicalBucket(bucket, r.target)
+
+	rep := &Report{Bucket: bucket}
+	if r.checkpoint != nil {
+		from, err := r.checkpoint.Load(ctx, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("reconcile: load checkpoint: %w", err)
+		}
+		rep.From = from
+	}
+	lim := newLimiter(r.interval)
+	defer lim.stop()
+	a := &lister{st: src, bucket: srcBucket, startAfter: rep.From, lim: lim}
+	b := &lister{st: dst, bucket: dstBucket, startAfter: rep.From, lim: lim}
+
+	for {
+		x, err := a.peek(ctx)
+		if err != nil {
+			return rep, err
+		}
+		y, err := b.peek(ctx)
+		if err != nil {
+			return rep, err
+		}
+		var d *Diff
+		var key string
+		switch {
+		case x == nil && y == nil:
+			if r.checkpoint != nil {
+				if err := r.checkpoint.Save(ctx, bucket, ""); err != nil {
+					return rep, fmt.Errorf("reconcile: save checkpoint: %w", err)
+				}
+			}
+			return rep, nil
+		case y == nil || (x != nil && aws.ToString(x.Key) < aws.ToString(y.Key)):
+			key = aws.ToString(x.Key)
+			d = &Diff{Key: key, Kind: DiffMissing, Source: x}
+			a.next()
+		case x == nil || aws.ToString(y.Key) < aws.ToString(x.Key):
+			key = aws.ToString(y.Key)
+			d = &Diff{Key: key, Kind: DiffExtra, Target: y}
+			b.next()
+		default:
+			key = aws.ToString(x.Key)
+			if !same(x, y) {
+				d = &Diff{Key: key, Kind: DiffMismatch, Source: x, Target: y}
+			}
+			a.next()
+			b.next()
+		}
+		rep.Scanned++
+
+		if d != nil {
+			if r.repair && d.Kind != DiffExtra {
+				if err := lim.wait(ctx); err != nil {
+					return rep, err
+				}
+				d.Err = store.CopyObject(ctx, src, srcBucket, dst, dstBucket, key)
+				d.Repaired = d.Err == nil
+			}
+			rep.Diffs = append(rep.Diffs, *d)
+		}
+		if r.checkpoint != nil && r.every > 0 && rep.Scanned%r.every == 0 {
+			if err := r.checkpoint.Save(ctx, bucket, key); err != nil {
+				return rep, fmt.Errorf("reconcile: save checkpoint: %w", err)
+			}
+		}
+	}
+}
+
+// same reports whether two listings describe the same object. ETags are only
+// compared when neither is a multipart ETag, since those depend on part size.
+func same(x, y *types.Object) bool {
+	if aws.ToInt64(x.Size) != aws.ToInt64(y.Size) {
+		return false
+	}
+	ex, ey := aws.ToString(x.ETag), aws.ToString(y.ETag)
+	if ex == "" || ey == "" || strings.Contains(ex, "-") || strings.Contains(ey, "-") {
+		return true
+	}
+	return ex == ey
+}
+
+// lister pages through a bucket one object at a time.
+type lister struct {
+	st         store.Store
+	bucket     string
+	startAfter string
+	lim        *limiter
+
+	page  []types.Object
+	token *string
+	done  bool
+}
+
+func (l *lister) peek(ctx context.Context) (*types.Object, error) {
+	for len(l.page) == 0 && !l.done {
+		if err := l.lim.wait(ctx); err != nil {
+			return nil, err
+		}
+		in := &s3.ListObjectsV2Input{Bucket: aws.String(l.bucket), ContinuationToken: l.token}
+		if l.token == nil && l.startAfter != "" {
+			in.StartAfter = aws.String(l.startAfter)
+		}
+		out, err := l.st.ListObjectsV2(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("reconcile: list %s: %w", l.bucket, err)
+		}
+		l.page = out.Contents
+		l.token = out.NextContinuationToken
+		l.done = !aws.ToBool(out.IsTruncated)
+	}
+	if len(l.page) == 0 {
+		return nil, nil
+	}
+	return &l.page[0], nil
+}
+
+func (l *lister) next() {
+	l.page = l.page[1:]
+}
+
+// limiter spaces calls at least interval apart; a zero interval is unlimited.
+type limiter struct {
+	tick *time.Ticker
+}
+
+func newLimiter(interval time.Duration) *limiter {
+	if interval <= 0 {
+		return &limiter{}
+	}
+	return &limiter{tick: time.NewTicker(interval)}
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if l.tick == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.tick.C:
+		return nil
+	}
+}
+
+func (l *limiter) stop() {
+	if l.tick != nil {
+		l.tick.Stop()
+	}
+}
@@ -0,0 +1,149 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/store"
+)
+
+// bucketStore is a single-bucket store that lists pageSize keys at a time.
+type bucketStore struct {
+	store.Store
+	mu       sync.Mutex
+	objects  map[string]string
+	pageSize int
+	failList int // fail the n-th List call (1-based) when > 0
+	lists    int
+}
+
+func (b *bucketStore) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lists++
+	if b.lists == b.failList {
+		return nil, io.ErrUnexpectedEOF
+	}
+	keys := make([]string, 0, len(b.objects))
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// like S3, tokens resume after a key, not at an offset
+	after := aws.ToString(in.StartAfter)
+	if in.ContinuationToken != nil {
+		after = *in.ContinuationToken
+	}
+	start := 0
+	if after != "" {
+		start = sort.SearchStrings(keys, after+"\x00")
+	}
+	end := min(start+b.pageSize, len(keys))
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(keys))}
+	if end < len(keys) {
+		out.NextContinuationToken = aws.String(keys[end-1])
+	}
+	for _, k := range keys[start:end] {
+		v := b.objects[k]
+		out.Contents = append(out.Contents, types.Object{
+			Key: aws.String(k), Size: aws.Int64(int64(len(v))), ETag: aws.String(`"` + v + `"`),
+		})
+	}
+	return out, nil
+}
+
+func (b *bucketStore) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v, ok := b.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader([]byte(v)))}, nil
+}
+
+func (b *bucketStore) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, _ := io.ReadAll(in.Body)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[aws.ToString(in.Key)] = string(data)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func newStores() (src, dst *bucketStore, stores map[config.Endpoint]store.Store) {
+	src = &bucketStore{pageSize: 2, objects: map[string]string{
+		"a": "1", "b": "2", "c": "3", "d": "4", "e": "5",
+	}}
+	dst = &bucketStore{pageSize: 2, objects: map[string]string{
+		"a": "1", "c": "x", "d": "4", "z": "9",
+	}}
+	return src, dst, map[config.Endpoint]store.Store{
+		config.EndpointPrimary:   src,
+		config.EndpointSecondary: dst,
+	}
+}
+
+func TestRun_ReportsAndRepairs(t *testing.T) {
+	_, dst, stores := newStores()
+	r := New(&config.Config{}, stores, WithRepair())
+	rep, err := r.Run(context.Background(), "photos")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := map[string]DiffKind{"b": DiffMissing, "c": DiffMismatch, "e": DiffMissing, "z": DiffExtra}
+	if len(rep.Diffs) != len(want) || rep.Scanned != 6 {
+		t.Fatalf("got %d diffs over %d keys: %+v", len(rep.Diffs), rep.Scanned, rep.Diffs)
+	}
+	for _, d := range rep.Diffs {
+		if want[d.Key] != d.Kind {
+			t.Errorf("%s: got %s, want %s", d.Key, d.Kind, want[d.Key])
+		}
+		if d.Repaired != (d.Kind != DiffExtra) {
+			t.Errorf("%s: repaired = %v", d.Key, d.Repaired)
+		}
+	}
+	for k, v := range map[string]string{"b": "2", "c": "3", "e": "5", "z": "9"} {
+		if dst.objects[k] != v {
+			t.Errorf("target %s = %q, want %q", k, dst.objects[k], v)
+		}
+	}
+}
+
+func TestRun_ResumesFromCheckpoint(t *testing.T) {
+	src, _, stores := newStores()
+	cp := NewFileCheckpoint(filepath.Join(t.TempDir(), "cp.json"))
+	src.failList = 3 // third page: after "a".."d"
+	r := New(&config.Config{}, stores, WithCheckpoint(cp, 1))
+	if _, err := r.Run(context.Background(), "photos"); err == nil {
+		t.Fatalf("expected list error")
+	}
+	from, _ := cp.Load(context.Background(), "photos")
+	if from == "" {
+		t.Fatalf("no checkpoint saved")
+	}
+
+	rep, err := r.Run(context.Background(), "photos")
+	if err != nil {
+		t.Fatalf("resumed Run: %v", err)
+	}
+	if rep.From != from {
+		t.Fatalf("resumed from %q, want %q", rep.From, from)
+	}
+	for _, d := range rep.Diffs {
+		if d.Key <= from {
+			t.Errorf("resumed run revisited %q", d.Key)
+		}
+	}
+	if from, _ := cp.Load(context.Background(), "photos"); from != "" {
+		t.Errorf("checkpoint not cleared after full run: %q", from)
+	}
+}
@@ -0,0 +1,242 @@
+// Package replicate journals best-effort writes that have not yet reached
+// every endpoint and retries them in the background until they do.
+package replicate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wilbeibi/s3router/config"
+)
+
+// Kind is what a task does to its target.
+type Kind string
+
+const (
+	KindCopy    Kind = "copy"    // copy Key from Source to Target
+	KindDelete  Kind = "delete"  // delete Key on Target
+	KindTagging Kind = "tagging" // copy Key's tags from Source to Target
+)
+
+// Task is one write that still has to reach Target.
+type Task struct {
+	ID      string          `json:"id"`
+	Kind    Kind            `json:"kind"`
+	Bucket  string          `json:"bucket"` // logical bucket
+	Key     string          `json:"key"`
+	Source  config.Endpoint `json:"source,omitempty"`
+	Target  config.Endpoint `json:"target"`
+	Created time.Time       `json:"created"`
+}
+
+// Queue durably stores tasks until they are acknowledged. Implementations
+// must be safe for concurrent use.
+type Queue interface {
+	// Push records tasks together and assigns their IDs.
+	Push(ctx context.Context, tasks ...*Task) error
+	// Ack removes tasks once they have been applied.
+	Ack(ctx context.Context, ids ...string) error
+	// Pending returns the unacknowledged tasks, oldest first.
+	Pending(ctx context.Context) ([]Task, error)
+	// Len returns the number of unacknowledged tasks.
+	Len() int
+}
+
+// record is one line of the FileQueue journal.
+type record struct {
+	Push *Task  `json:"push,omitempty"`
+	Ack  string `json:"ack,omitempty"`
+}
+
+// FileQueue is a Queue backed by an append-only journal file. Every push and
+// ack is synced before it returns, with one sync per call however many
+// tasks it carries; the journal is compacted when opened.
+type FileQueue struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	nextID uint64
+	tasks  map[string]Task
+	order  []string // push order, pruned of acked IDs by Pending
+}
+
+var _ Queue = (*FileQueue)(nil)
+
+// OpenFileQueue opens or creates the journal at path and replays it.
+func OpenFileQueue(path string) (*FileQueue, error) {
+	q := &FileQueue{path: path, tasks: make(map[string]Task)}
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *FileQueue) replay() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		var rec record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// A torn final write is expected after a crash.
+			if !sc.Scan() {
+				break
+			}
+			return fmt.Errorf("%s:%d: %w", q.path, line, err)
+		}
+		switch {
+		case rec.Push != nil:
+			q.add(*rec.Push)
+		case rec.Ack != "":
+			delete(q.tasks, rec.Ack)
+		}
+	}
+	return sc.Err()
+}
+
+func (q *FileQueue) add(t Task) {
+	q.tasks[t.ID] = t
+	q.order = append(q.order, t.ID)
+	if n, err := strconv.ParseUint(t.ID, 10, 64); err == nil && n >= q.nextID {
+		q.nextID = n + 1
+	}
+}
+
+// compact rewrites the journal with only the pending tasks.
+func (q *FileQueue) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	order := q.order[:0]
+	enc := json.NewEncoder(tmp)
+	for _, id := range q.order {
+		t, ok := q.tasks[id]
+		if !ok {
+			continue
+		}
+		order = append(order, id)
+		if err := enc.Encode(record{Push: &t}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	q.order = order
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		return err
+	}
+	q.f, err = os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// write appends recs to the journal and syncs it once.
+func (q *FileQueue) write(recs ...record) error {
+	var buf []byte
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	if _, err := q.f.Write(buf); err != nil {
+		return err
+	}
+	return q.f.Sync()
+}
+
+func (q *FileQueue) Push(_ context.Context, tasks ...*Task) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	recs := make([]record, len(tasks))
+	for i, t := range tasks {
+		t.ID = strconv.FormatUint(q.nextID+uint64(i), 10)
+		if t.Created.IsZero() {
+			t.Created = time.Now()
+		}
+		recs[i] = record{Push: t}
+	}
+	if err := q.write(recs...); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		q.add(*t)
+	}
+	return nil
+}
+
+func (q *FileQueue) Ack(_ context.Context, ids ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var recs []record
+	for _, id := range ids {
+		if _, ok := q.tasks[id]; ok {
+			recs = append(recs, record{Ack: id})
+		}
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	if err := q.write(recs...); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		delete(q.tasks, rec.Ack)
+	}
+	return nil
+}
+
+func (q *FileQueue) Pending(_ context.Context) ([]Task, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks := make([]Task, 0, len(q.tasks))
+	order := q.order[:0]
+	for _, id := range q.order {
+		if t, ok := q.tasks[id]; ok {
+			tasks = append(tasks, t)
+			order = append(order, id)
+		}
+	}
+	q.order = order
+	return tasks, nil
+}
+
+func (q *FileQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// Close closes the journal file.
+func (q *FileQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.f.Close()
+}
@@ -0,0 +1,85 @@
+package replicate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileQueue_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q, err := OpenFileQueue(path)
+	if err != nil {
+		t.Fatalf("OpenFileQueue: %v", err)
+	}
+	a := &Task{Kind: KindCopy, Bucket: "photos", Key: "a", Source: "primary", Target: "secondary"}
+	b := &Task{Kind: KindDelete, Bucket: "photos", Key: "b", Target: "secondary"}
+	for _, task := range []*Task{a, b} {
+		if err := q.Push(ctx, task); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	if err := q.Ack(ctx, a.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	q.Close()
+
+	// simulate a crash in the middle of a write
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"push":{"id":"9","ki`)
+	f.Close()
+
+	q, err = OpenFileQueue(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer q.Close()
+	tasks, _ := q.Pending(ctx)
+	if len(tasks) != 1 || tasks[0].ID != b.ID || tasks[0].Key != "b" {
+		t.Fatalf("Pending after reopen = %+v, want only %q", tasks, b.Key)
+	}
+
+	c := &Task{Kind: KindCopy, Bucket: "photos", Key: "c", Target: "secondary"}
+	if err := q.Push(ctx, c); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if c.ID == a.ID || c.ID == b.ID {
+		t.Fatalf("reused task ID %q", c.ID)
+	}
+}
+
+func TestFileQueue_Batch(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q, err := OpenFileQueue(path)
+	if err != nil {
+		t.Fatalf("OpenFileQueue: %v", err)
+	}
+	tasks := []*Task{
+		{Kind: KindDelete, Bucket: "photos", Key: "a", Target: "secondary"},
+		{Kind: KindDelete, Bucket: "photos", Key: "b", Target: "secondary"},
+		{Kind: KindDelete, Bucket: "photos", Key: "c", Target: "secondary"},
+	}
+	if err := q.Push(ctx, tasks...); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if tasks[0].ID == tasks[1].ID || tasks[1].ID == tasks[2].ID || tasks[0].ID == tasks[2].ID {
+		t.Fatalf("batch shares IDs: %q, %q, %q", tasks[0].ID, tasks[1].ID, tasks[2].ID)
+	}
+	if err := q.Ack(ctx, tasks[0].ID, tasks[2].ID, "unknown"); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	q.Close()
+
+	q, err = OpenFileQueue(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer q.Close()
+	pending, _ := q.Pending(ctx)
+	if len(pending) != 1 || pending[0].Key != "b" {
+		t.Fatalf("Pending after reopen = %+v, want only %q", pending, "b")
+	}
+}
@@ -0,0 +1,269 @@
+package replicate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/store"
+)
+
+// Option configures a Replicator.
+type Option func(*Replicator)
+
+// WithBackoff sets the first retry delay and the cap it doubles up to.
+// Defaults to 1s and 5m.
+func WithBackoff(first, limit time.Duration) Option {
+	return func(r *Replicator) {
+		r.minBackoff, r.maxBackoff = first, limit
+	}
+}
+
+// Replicator applies queued tasks with exponential backoff. Tasks still
+// owned by the request that journaled them are left alone until that
+// request finishes.
+type Replicator struct {
+	cfg        *config.Config
+	stores     map[config.Endpoint]store.Store
+	q          Queue
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// pushing is held shared while requests journal tasks, and exclusively
+	// while the retry loop reads the queue, so the loop never sees a task
+	// before it is marked in flight. No one waits on r.mu for disk I/O.
+	pushing  sync.RWMutex
+	mu       sync.Mutex
+	inflight map[string]bool
+	retries  map[string]retry
+
+	stop   chan struct{}
+	cancel context.CancelFunc // cancels the background loop's work
+	done   chan struct{}      // nil until Start
+}
+
+type retry struct {
+	attempts int
+	next     time.Time
+}
+
+func NewReplicator(cfg *config.Config, stores map[config.Endpoint]store.Store, q Queue, opts ...Option) *Replicator {
+	r := &Replicator{
+		cfg:        cfg,
+		stores:     stores,
+		q:          q,
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+		inflight:   make(map[string]bool),
+		retries:    make(map[string]retry),
+		stop:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Start runs the background retry loop until Stop or Drain.
+func (r *Replicator) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done != nil {
+		return
+	}
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	r.done, r.cancel = done, cancel
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(r.minBackoff)
+		defer tick.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-tick.C:
+				r.runOnce(ctx, false)
+			}
+		}
+	}()
+}
+
+// Stop ends the background loop, abandoning any task it is applying and
+// leaving pending tasks in the queue.
+func (r *Replicator) Stop() {
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	done := r.done
+	r.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Begin journals tasks, in one push, on behalf of a request that is about
+// to attempt them. The request must call Finish with the outcome.
+func (r *Replicator) Begin(ctx context.Context, tasks ...*Task) error {
+	r.pushing.RLock()
+	defer r.pushing.RUnlock()
+	if err := r.q.Push(ctx, tasks...); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	for _, t := range tasks {
+		r.inflight[t.ID] = true
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// Finish acknowledges tasks if the request's own attempt succeeded,
+// otherwise hands them over to the retry loop.
+func (r *Replicator) Finish(ctx context.Context, err error, tasks ...*Task) {
+	if err == nil {
+		ids := make([]string, len(tasks))
+		for i, t := range tasks {
+			ids[i] = t.ID
+		}
+		// An ack that fails to persist only means a redundant retry later.
+		_ = r.q.Ack(ctx, ids...)
+	}
+	r.mu.Lock()
+	for _, t := range tasks {
+		delete(r.inflight, t.ID)
+	}
+	r.mu.Unlock()
+}
+
+// Depth returns the number of tasks that have not reached their target.
+func (r *Replicator) Depth() int {
+	return r.q.Len()
+}
+
+// Drain stops the background loop and retries every pending task, ignoring
+// backoff, until the queue is empty or ctx is done.
+func (r *Replicator) Drain(ctx context.Context) error {
+	r.Stop()
+	for r.q.Len() > 0 {
+		r.runOnce(ctx, true)
+		if r.q.Len() == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.minBackoff):
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) runOnce(ctx context.Context, force bool) {
+	r.pushing.Lock()
+	tasks, err := r.q.Pending(ctx)
+	r.pushing.Unlock()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, t := range tasks {
+		if ctx.Err() != nil {
+			return
+		}
+		r.mu.Lock()
+		rs, busy := r.retries[t.ID], r.inflight[t.ID]
+		r.mu.Unlock()
+		if busy || (!force && now.Before(rs.next)) {
+			continue
+		}
+		if err := r.apply(ctx, t); err != nil {
+			rs.attempts++
+			rs.next = time.Now().Add(r.backoff(rs.attempts))
+			r.mu.Lock()
+			r.retries[t.ID] = rs
+			r.mu.Unlock()
+			continue
+		}
+		_ = r.q.Ack(ctx, t.ID)
+		r.mu.Lock()
+		delete(r.retries, t.ID)
+		r.mu.Unlock()
+	}
+}
+
+func (r *Replicator) backoff(attempts int) time.Duration {
+	d := r.minBackoff
+	for i := 1; i < attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, r.maxBackoff)
+}
+
+// apply brings t.Target in line with t.Source for a single key. A copy whose
+// source no longer has the key has nothing left to replicate, nor has a
+// tag change whose target lacks it; the copy that brings it brings its tags.
+func (r *Replicator) apply(ctx context.Context, t Task) error {
+	dst := r.stores[t.Target]
+	if dst == nil {
+		return errors.New("replicate: unknown endpoint " + string(t.Target))
+	}
+	bucket := aws.String(r.cfg.PhysicalBucket(t.Bucket, t.Target))
+	switch t.Kind {
+	case KindDelete:
+		_, err := dst.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String(t.Key)})
+		return err
+	case KindCopy:
+		src := r.stores[t.Source]
+		if src == nil {
+			return errors.New("replicate: unknown endpoint " + string(t.Source))
+		}
+		err := store.CopyObject(ctx, src, r.cfg.PhysicalBucket(t.Bucket, t.Source), dst, *bucket, t.Key)
+		if store.IsNotFound(err) {
+			return nil
+		}
+		return err
+	case KindTagging:
+		src := r.stores[t.Source]
+		if src == nil {
+			return errors.New("replicate: unknown endpoint " + string(t.Source))
+		}
+		err := copyTags(ctx, src, r.cfg.PhysicalBucket(t.Bucket, t.Source), dst, *bucket, t.Key)
+		if store.IsNotFound(err) {
+			return nil
+		}
+		return err
+	default:
+		return errors.New("replicate: unknown task kind " + string(t.Kind))
+	}
+}
+
+// copyTags replaces the tags of key in dstBucket on dst with those it has in
+// srcBucket on src, leaving the object itself alone.
+func copyTags(ctx context.Context, src store.Store, srcBucket string, dst store.Store, dstBucket, key string) error {
+	tags, err := src.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(srcBucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	if len(tags.TagSet) == 0 {
+		_, err = dst.DeleteObjectTagging(ctx, &s3.DeleteObjectTaggingInput{Bucket: aws.String(dstBucket), Key: aws.String(key)})
+		return err
+	}
+	_, err = dst.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(dstBucket),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: tags.TagSet},
+	})
+	return err
+}
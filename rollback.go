@@ -0,0 +1,130 @@
+package s3router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/wilbeibi/s3router/config"
+)
+
+// WithMirrorRollback makes a mirrored PutObject, CopyObject or
+// CompleteMultipartUpload that fails on some endpoints delete the copies it wrote to the others.
+// Where the write created a version, only that version is deleted, so a
+// versioned bucket gets its previous object back; otherwise the key is
+// deleted outright.
+func WithMirrorRollback() Option {
+	return func(c *router) {
+		c.mirrorRollback = true
+	}
+}
+
+// RollbackError is returned by a mirrored write that failed after reaching
+// some endpoints, when WithMirrorRollback is set. Err is the write's
+// failure; the copies on RolledBack were deleted, those in Failed remain.
+type RollbackError struct {
+	Err        error
+	RolledBack []config.Endpoint
+	Failed     []EndpointError
+}
+
+// Compensated reports whether every copy that was written has been deleted.
+func (e *RollbackError) Compensated() bool { return len(e.Failed) == 0 }
+
+func (e *RollbackError) Error() string {
+	msg := fmt.Sprintf("mirror write failed: %v", e.Err)
+	if len(e.RolledBack) > 0 {
+		eps := make([]string, len(e.RolledBack))
+		for i, ep := range e.RolledBack {
+			eps[i] = string(ep)
+		}
+		msg += "; rolled back on " + strings.Join(eps, ", ")
+	}
+	if len(e.Failed) > 0 {
+		msgs := make([]string, len(e.Failed))
+		for i, f := range e.Failed {
+			msgs[i] = f.Error()
+		}
+		msg += "; rollback failed: " + strings.Join(msgs, "; ")
+	}
+	return msg
+}
+
+func (e *RollbackError) Unwrap() error { return e.Err }
+
+// rollbackWrite lets a mirrored write of key on rt undo itself on the
+// targets it reached.
+func (c *router) rollbackWrite(rt *route, key string) {
+	if !c.mirrorRollback || rt.action != config.ActMirror {
+		return
+	}
+	rt.rollback = func(ctx context.Context, t target, versionID *string) error {
+		_, err := t.st.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:    aws.String(t.bucket),
+			Key:       aws.String(key),
+			VersionId: versionID,
+		})
+		return err
+	}
+}
+
+// doMirrorRollback is a strict doParallel that, when some targets fail,
+// rolls back the ones that succeeded.
+func doMirrorRollback[T any](
+	ctx context.Context,
+	rt route,
+	op func(context.Context, target) (T, error),
+) (T, error) {
+	var wg sync.WaitGroup
+	outs := make([]T, len(rt.targets))
+	errs := make([]error, len(rt.targets))
+	wg.Add(len(rt.targets))
+	for i, t := range rt.targets {
+		go func() {
+			defer wg.Done()
+			outs[i], errs[i] = op(ctx, t)
+		}()
+	}
+	wg.Wait()
+
+	rerr := &RollbackError{}
+	for _, err := range errs {
+		if err != nil {
+			rerr.Err = err
+			break
+		}
+	}
+	if rerr.Err == nil {
+		return outs[0], nil
+	}
+	// The rollback must run even if the write failed because ctx ended.
+	ctx = context.WithoutCancel(ctx)
+	for i, t := range rt.targets {
+		if errs[i] != nil {
+			continue
+		}
+		if err := rt.rollback(ctx, t, versionOf(outs[i])); err != nil {
+			rerr.Failed = append(rerr.Failed, EndpointError{Endpoint: t.name, Err: err})
+			continue
+		}
+		rerr.RolledBack = append(rerr.RolledBack, t.name)
+	}
+	var zero T
+	return zero, rerr
+}
+
+// versionOf returns the version a write created, if any.
+func versionOf(out any) *string {
+	switch o := out.(type) {
+	case *s3.PutObjectOutput:
+		return o.VersionId
+	case *s3.CompleteMultipartUploadOutput:
+		return o.VersionId
+	case *s3.CopyObjectOutput:
+		return o.VersionId
+	}
+	return nil
+}
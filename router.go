@@ -8,10 +8,9 @@ flowchart TD
     route -->|3a choose| lookup
     lookup --> route
     route -->|3b dispatch| doSerial & doParallel
-    doSerial -->|4| primaryFn & secondaryFn
-    doParallel -->|4| primaryFn & secondaryFn
-    primaryFn -->|5| primarySDK[s3.Client.GetObject]
-    secondaryFn -->|5| secondarySDK[s3.Client.GetObject]
+    doSerial -->|4| fn[op per target]
+    doParallel -->|4| fn
+    fn -->|5| sdk[s3.Client.GetObject on each endpoint]
 */
 
 package s3router
@@ -19,14 +18,38 @@ package s3router
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/replicate"
 	"github.com/wilbeibi/s3router/store"
 )
 
+// Router is the store.Store returned by New, along with its management API.
+type Router interface {
+	store.Store
+
+	// QueueDepth returns the number of best-effort writes that have not yet
+	// reached every endpoint. It is always 0 without WithReplicationQueue.
+	QueueDepth() int
+	// Drain stops background replication and retries queued writes until
+	// the queue is empty or ctx is done. Call it on shutdown.
+	Drain(ctx context.Context) error
+	// BreakerStates returns the circuit breaker state of every endpoint.
+	// They are always closed without WithCircuitBreaker.
+	BreakerStates() map[config.Endpoint]BreakerState
+	// BufferedBytes returns the memory currently held by buffered request
+	// bodies.
+	BufferedBytes() int64
+}
+
 // Option configures the router.
 type Option func(*router)
 
@@ -37,19 +60,62 @@ func WithMaxBufferBytes(n int64) Option {
 	}
 }
 
+// WithUploadStore sets where multipart upload IDs are mapped across
+// endpoints. Defaults to an in-memory store.
+func WithUploadStore(s store.UploadStore) Option {
+	return func(c *router) {
+		c.uploads = s
+	}
+}
+
+// WithReplicationQueue journals best-effort writes to q before they are
+// sent, and retries the ones that fail in the background until they reach
+// their endpoint.
+func WithReplicationQueue(q replicate.Queue, opts ...replicate.Option) Option {
+	return func(c *router) {
+		c.queue, c.replOpts = q, opts
+	}
+}
+
 // New builds the facade around two pre-configured stores.
 func New(cfg *config.Config,
 	primary, secondary store.Store,
-	opts ...Option) (store.Store, error) {
+	opts ...Option) (Router, error) {
+	return NewMulti(cfg, map[config.Endpoint]store.Store{
+		config.EndpointPrimary:   primary,
+		config.EndpointSecondary: secondary,
+	}, opts...)
+}
+
+// NewMulti builds the facade around one pre-configured store per endpoint
+// in cfg.EndpointOrder.
+func NewMulti(cfg *config.Config,
+	stores map[config.Endpoint]store.Store,
+	opts ...Option) (Router, error) {
+	for _, ep := range cfg.EndpointOrder {
+		if stores[ep] == nil {
+			return nil, fmt.Errorf("no store for endpoint %q", ep)
+		}
+	}
 	c := &router{
 		cfg:            cfg,
-		primary:        primary,
-		secondary:      secondary,
+		stores:         stores,
 		maxBufferBytes: 256 << 20,
+		tee:            defaultTee,
+		copyPartSize:   64 << 20,
+		uploads:        store.NewMemoryUploadStore(),
+		latencies:      make(map[config.Endpoint]*latencies, len(cfg.EndpointOrder)),
+	}
+	for _, ep := range cfg.EndpointOrder {
+		c.latencies[ep] = &latencies{}
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.queue != nil {
+		c.repl = replicate.NewReplicator(cfg, stores, c.queue, c.replOpts...)
+		c.repl.Start()
+	}
 	return c, nil
 }
 
@@ -57,129 +123,514 @@ func New(cfg *config.Config,
 // before calling New.
 func S3Clients(cfg *config.Config,
 	primarySDK, secondarySDK *s3.Client,
-	opts ...Option) (store.Store, error) {
+	opts ...Option) (Router, error) {
 	// *s3.Client already satisfies store.Store, so pass directly
 	return New(cfg, primarySDK, secondarySDK, opts...)
 }
 
 type router struct {
 	cfg            *config.Config
-	primary        store.Store
-	secondary      store.Store
+	stores         map[config.Endpoint]store.Store
 	maxBufferBytes int64 // 256 MiB default
+	tee            teeConfig
+	copyPartSize   int64 // 64 MiB default
+	uploads        store.UploadStore
+	queue          replicate.Queue
+	replOpts       []replicate.Option
+	repl           *replicate.Replicator          // nil without a queue
+	migrating      sync.Map                       // "endpoint/bucket/key" of copies in flight
+	breakers       map[config.Endpoint]*breaker   // nil without WithCircuitBreaker
+	latencies      map[config.Endpoint]*latencies // of successful hedged reads
+	mirrorRollback bool
+	onMismatch     func(context.Context, *ChecksumError) // nil without WithChecksumMismatch
+	onDivergence   func(context.Context, Divergence)     // nil without WithReadRepairReport
+	spool          *spooler                              // nil without WithSpillToDisk
+	budget         *byteBudget                           // nil without WithBufferBudget
+	buffered       atomic.Int64                          // bytes held by buffered bodies
+}
+
+func (c *router) QueueDepth() int {
+	if c.repl == nil {
+		return 0
+	}
+	return c.repl.Depth()
+}
+
+func (c *router) Drain(ctx context.Context) error {
+	if c.repl == nil {
+		return nil
+	}
+	return c.repl.Drain(ctx)
+}
+
+// target is one endpoint a request may be sent to, in routing order.
+type target struct {
+	i      int // position in the routed endpoint list
+	name   config.Endpoint
+	st     store.Store
+	bucket string   // physical bucket on this endpoint
+	br     *breaker // nil without WithCircuitBreaker
+	lat    *latencies
+}
+
+// route is the resolved plan for one request.
+type route struct {
+	action   config.Action
+	targets  []target
+	acks     int                 // for config.ActQuorum
+	prefer   config.Endpoint     // for config.ActMerge
+	failover []config.ErrorClass // for serial actions
+	delay    config.HedgeDelay   // for config.ActHedge
+	verify   config.Verify       // for config.ActMirror
+	repair   config.Repair       // for config.ActFallback
+
+	// journal, if set, durably records a best-effort write to t before it
+	// is sent. finish reports the outcome of the attempt.
+	journal func(ctx context.Context, t target) (finish func(error), err error)
+	// rollback, if set, deletes what a mirrored write that failed elsewhere
+	// wrote to t.
+	rollback func(ctx context.Context, t target, versionID *string) error
+	// bodies, if set, are each target's own copy of the request body. Each
+	// is released once its target's request returns, or is skipped.
+	bodies []io.Reader
+}
+
+// route resolves the action for op and the endpoints it applies to.
+func (c *router) route(op, bucket, key string) (route, error) {
+	if !c.cfg.IsLogicalBucket(bucket) {
+		return route{}, fmt.Errorf("%s: bucket %q is not configured", op, bucket)
+	}
+	r := c.cfg.Resolve(bucket, key, op)
+	rt := route{
+		action:   r.Action,
+		targets:  make([]target, len(r.Targets)),
+		acks:     r.Acks,
+		prefer:   r.Prefer,
+		failover: r.Failover,
+		delay:    r.Delay,
+		verify:   r.Verify,
+		repair:   r.Repair,
+	}
+	for i, ep := range r.Targets {
+		rt.targets[i] = c.target(i, ep, bucket)
+	}
+	return rt, nil
+}
+
+// target returns endpoint ep as the i-th target of a request to bucket.
+func (c *router) target(i int, ep config.Endpoint, bucket string) target {
+	return target{
+		i:      i,
+		name:   ep,
+		st:     c.stores[ep],
+		bucket: c.cfg.PhysicalBucket(bucket, ep),
+		br:     c.breakers[ep],
+		lat:    c.latencies[ep],
+	}
+}
+
+// journal makes best-effort writes on rt record a task for each key on
+// every target after the first, so a replica that misses the write is
+// retried from the first target later.
+func (c *router) journal(rt *route, kind replicate.Kind, bucket string, keys ...string) {
+	if c.repl == nil || rt.action != config.ActBestEffort {
+		return
+	}
+	source := rt.targets[0].name
+	rt.journal = func(ctx context.Context, t target) (func(error), error) {
+		ctx = context.WithoutCancel(ctx)
+		tasks := make([]*replicate.Task, len(keys))
+		for i, key := range keys {
+			tasks[i] = &replicate.Task{Kind: kind, Bucket: bucket, Key: key, Source: source, Target: t.name}
+		}
+		if err := c.repl.Begin(ctx, tasks...); err != nil {
+			return nil, err
+		}
+		return func(err error) { c.repl.Finish(ctx, err, tasks...) }, nil
+	}
+}
+
+// journaled records every write rt will send in the background before any
+// is sent, and wraps op to report each outcome back to the journal.
+func journaled[T any](
+	ctx context.Context,
+	rt route,
+	op func(context.Context, target) (T, error),
+) (func(context.Context, target) (T, error), error) {
+	if rt.journal == nil {
+		return op, nil
+	}
+	finish := make([]func(error), len(rt.targets))
+	for _, t := range rt.targets[1:] {
+		f, err := rt.journal(ctx, t)
+		if err != nil {
+			for _, f := range finish {
+				if f != nil {
+					f(err)
+				}
+			}
+			return nil, fmt.Errorf("failed to journal write to %s: %w", t.name, err)
+		}
+		finish[t.i] = f
+	}
+	return func(ctx context.Context, t target) (T, error) {
+		out, err := op(ctx, t)
+		if f := finish[t.i]; f != nil {
+			f(err)
+		}
+		return out, err
+	}, nil
 }
 
-// Serial "primary-then-secondary if needed" (fallback).
-func doSerial[I any, T any](
+// Serial "first, then the next one if needed" (fallback). Only errors in
+// the failover classes move on; nil means config.DefaultFailover.
+func doSerial[T any](
 	ctx context.Context,
-	op func(context.Context, store.Store, I) (T, error),
-	in1, in2 I,
-	s1, s2 store.Store,
+	op func(context.Context, target) (T, error),
+	targets []target,
+	failover []config.ErrorClass,
 ) (T, error) {
-	out, err := op(ctx, s1, in1)
-	if err == nil {
-		return out, nil
+	var (
+		out T
+		err error
+	)
+	for _, t := range targets {
+		out, err = op(ctx, t)
+		if err == nil || !failsOver(ctx, err, failover) {
+			return out, err
+		}
 	}
-	return op(ctx, s2, in2)
+	return out, err
 }
 
-// Parallel dual-write/read. strict==true => mirror; false => best-effort.
-func doParallel[I any, T any](
+// failsOver reports whether err from one endpoint should be retried on the
+// next. The caller's own cancellation never is; an open circuit always is.
+func failsOver(ctx context.Context, err error, failover []config.ErrorClass) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	if errors.Is(err, ErrBodyNotReplayable) {
+		return false
+	}
+	if failover == nil {
+		failover = config.DefaultFailover
+	}
+	return slices.Contains(failover, store.Classify(err))
+}
+
+// Parallel fan-out write/read. strict==true => mirror; false => best-effort.
+// The first target's output is returned.
+func doParallel[T any](
 	ctx context.Context,
 	strict bool,
-	op func(context.Context, store.Store, I) (T, error),
-	in1, in2 I,
-	s1, s2 store.Store,
+	op func(context.Context, target) (T, error),
+	targets []target,
 ) (T, error) {
 	if strict {
 		var wg sync.WaitGroup
-		var out T
-		var errA, errB error
-		wg.Add(2)
+		outs := make([]T, len(targets))
+		errs := make([]error, len(targets))
+		wg.Add(len(targets))
+		for i, t := range targets {
+			go func() {
+				defer wg.Done()
+				outs[i], errs[i] = op(ctx, t)
+			}()
+		}
+		wg.Wait()
+		for _, out := range outs[1:] {
+			discard(out)
+		}
+		for _, err := range errs {
+			if err != nil {
+				discard(outs[0])
+				var zero T
+				return zero, err
+			}
+		}
+		return outs[0], nil
+	}
+	// best-effort: fire-and-forget the rest, alongside the first so that
+	// they can read a teed body as it streams
+	for _, t := range targets[1:] {
 		go func() {
-			defer wg.Done()
-			out, errA = op(ctx, s1, in1)
+			out, _ := op(ctx, t)
+			discard(out)
 		}()
+	}
+	return op(ctx, targets[0])
+}
+
+// Quorum fan-out: succeed as soon as acks targets acknowledge, fail as soon
+// as that can no longer happen. Of the acknowledged outputs, the one from the
+// earliest target is returned. Stragglers keep running in the background.
+func doQuorum[T any](
+	ctx context.Context,
+	acks int,
+	op func(context.Context, target) (T, error),
+	targets []target,
+) (T, error) {
+	type result struct {
+		t   target
+		out T
+		err error
+	}
+	results := make(chan result, len(targets))
+	for _, t := range targets {
 		go func() {
-			defer wg.Done()
-			_, errB = op(ctx, s2, in2)
+			out, err := op(ctx, t)
+			results <- result{t, out, err}
 		}()
-		wg.Wait()
-		if errA != nil {
-			var zero T
-			return zero, errA
+	}
+	var (
+		out   T
+		first = -1
+		qerr  = &QuorumError{Need: acks}
+	)
+	// The outputs of stragglers are discarded as they come in.
+	discardRest := func(received int) {
+		go func() {
+			for range len(targets) - received {
+				discard((<-results).out)
+			}
+		}()
+	}
+	for received := 1; received <= len(targets); received++ {
+		r := <-results
+		if r.err != nil {
+			qerr.Failed = append(qerr.Failed, EndpointError{Endpoint: r.t.name, Err: r.err})
+			if len(qerr.Failed) > len(targets)-acks {
+				discard(out)
+				discardRest(received)
+				break
+			}
+			continue
 		}
-		if errB != nil {
-			var zero T
-			return zero, errB
+		qerr.Acked++
+		if first < 0 || r.t.i < first {
+			discard(out)
+			out, first = r.out, r.t.i
+		} else {
+			discard(r.out)
+		}
+		if qerr.Acked >= acks {
+			discardRest(received)
+			return out, nil
 		}
-		return out, nil
 	}
-	// best-effort: fire-and-forget secondary
-	out, err := op(ctx, s1, in1)
-	go func() {
-		_, _ = op(ctx, s2, in2)
-	}()
-	return out, err
+	var zero T
+	return zero, qerr
+}
+
+// discard releases an output that is not returned to the caller.
+func discard[T any](out T) {
+	if o, ok := any(out).(*s3.GetObjectOutput); ok && o != nil && o.Body != nil {
+		o.Body.Close()
+	}
+}
+
+// EndpointError is an error returned by a single endpoint.
+type EndpointError struct {
+	Endpoint config.Endpoint
+	Err      error
 }
 
-func drainBody(ctx context.Context, r io.Reader) (io.ReadSeeker, io.ReadSeeker, error) {
+func (e EndpointError) Error() string { return fmt.Sprintf("%s: %v", e.Endpoint, e.Err) }
+func (e EndpointError) Unwrap() error { return e.Err }
+
+// QuorumError is returned when fewer than Need endpoints acknowledged a
+// quorum write. Failed lists the endpoints that had failed by then.
+type QuorumError struct {
+	Need, Acked int
+	Failed      []EndpointError
+}
+
+func (e *QuorumError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("quorum not reached (%d of %d acks): %s", e.Acked, e.Need, strings.Join(msgs, "; "))
+}
+
+func (e *QuorumError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f
+	}
+	return errs
+}
+
+func drainBody(ctx context.Context, r io.Reader, n int) ([]io.Reader, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	if ctx.Err() != nil {
-		return nil, nil, ctx.Err()
-	}
-	return bytes.NewReader(data), bytes.NewReader(data), nil
-}
-
-func teeBody(ctx context.Context, r io.Reader) (io.ReadCloser, io.ReadCloser, error) {
-	pr1, pw1 := io.Pipe()
-	pr2, pw2 := io.Pipe()
-	go func() {
-		defer pw1.Close()
-		defer pw2.Close()
-
-		select {
-		case <-ctx.Done():
-			err := ctx.Err()
-			pw1.CloseWithError(err)
-			pw2.CloseWithError(err)
-			return
-		default:
-			_, err := io.Copy(io.MultiWriter(pw1, pw2), r)
-			if err != nil {
-				pw1.CloseWithError(err)
-				pw2.CloseWithError(err)
-			}
+		return nil, ctx.Err()
+	}
+	readers := make([]io.Reader, n)
+	for i := range readers {
+		readers[i] = bytes.NewReader(data)
+	}
+	return readers, nil
+}
+
+// splitBody returns n independent readers over body. With WithSpillToDisk
+// the spooler decides; otherwise bodies of known size below maxBufferBytes
+// are buffered in memory, anything else is teed.
+func (c *router) splitBody(ctx context.Context, body io.Reader, size *int64, n int) ([]io.Reader, error) {
+	if c.spool != nil {
+		return c.spool.split(ctx, body, size, n, func(r io.Reader) ([]io.Reader, error) {
+			return teeBody(ctx, r, n, c.tee)
+		})
+	}
+	// If ContentLength is not provided, S3 use chunked transfer encoding.
+	if size == nil || *size >= c.maxBufferBytes {
+		return teeBody(ctx, body, n, c.tee)
+	}
+	if readers, err := c.bufferBody(ctx, body, *size, n); readers != nil || err != nil {
+		return readers, err
+	}
+	return teeBody(ctx, body, n, c.tee)
+}
+
+// targetBodies gives each target of rt its own copy of a request body when
+// the action sends it to more than one of them, or returns nil.
+func (c *router) targetBodies(ctx context.Context, rt route, body io.Reader, size *int64) ([]io.Reader, error) {
+	if body == nil {
+		return nil, nil
+	}
+	switch rt.action {
+	case config.ActMirror, config.ActQuorum:
+		bodies, err := c.splitBody(ctx, body, size, len(rt.targets))
+		if err != nil {
+			return nil, fmt.Errorf("failed to split body for %s: %w", rt.action, err)
+		}
+		return bodies, nil
+	case config.ActBestEffort:
+		bodies, err := c.bestEffortBodies(ctx, body, size, len(rt.targets))
+		if err != nil {
+			return nil, fmt.Errorf("failed to buffer body for %s: %w", rt.action, err)
+		}
+		return bodies, nil
+	case config.ActFallback:
+		if len(rt.targets) < 2 {
+			return nil, nil
+		}
+		bodies, err := c.fallbackBodies(ctx, body, size, len(rt.targets))
+		if err != nil {
+			return nil, fmt.Errorf("failed to buffer body for %s: %w", rt.action, err)
 		}
-	}()
+		return bodies, nil
+	}
+	return nil, nil
+}
+
+// errBodyNotCopied fails a best-effort write to a target after the first
+// when it fell too far behind the first target to be given the whole body.
+// With a replication queue, the write is retried later by copying from the
+// first target.
+var errBodyNotCopied = errors.New("best-effort target fell behind reading the request body")
+
+// bestEffortBodies returns n independent readers over body. Bodies of known
+// size below maxBufferBytes are buffered in memory; anything else is teed
+// so that the first target never waits for the others.
+func (c *router) bestEffortBodies(ctx context.Context, body io.Reader, size *int64, n int) ([]io.Reader, error) {
+	if size == nil || *size >= c.maxBufferBytes {
+		return c.bestEffortTee(body, n, c.maxBufferBytes), nil
+	}
+	if readers, err := c.bufferBody(ctx, body, *size, n); readers != nil || err != nil {
+		return readers, err
+	}
+	return c.bestEffortTee(body, n, c.maxBufferBytes), nil
+}
+
+// releasing wraps op to let go of t's copy of the body once op returns, so
+// a tee stops waiting on it and buffers are freed.
+func releasing[T any](op func(context.Context, target) (T, error), bodies []io.Reader) func(context.Context, target) (T, error) {
+	return func(ctx context.Context, t target) (T, error) {
+		defer releaseBody(bodies[t.i])
+		return op(ctx, t)
+	}
+}
 
-	return pr1, pr2, nil
+func releaseBody(body io.Reader) {
+	if r, ok := body.(interface{ release() }); ok {
+		r.release()
+	}
 }
 
-// dispatch executes the primary and secondary functions according to action.
-func dispatch[I any, T any](
+// rewinding rewinds a fallback body before each attempt, and fails the
+// attempt if the body cannot be replayed after an earlier one read it.
+// Attempts must be serial.
+func rewinding[T any](op func(context.Context, target) (T, error), bodies []io.Reader) func(context.Context, target) (T, error) {
+	var (
+		prev config.Endpoint
+		last error
+	)
+	return func(ctx context.Context, t target) (T, error) {
+		if r, ok := bodies[t.i].(interface{ rewind() error }); ok {
+			if err := r.rewind(); err != nil {
+				var zero T
+				return zero, fmt.Errorf("cannot fall back to %s: %w; %s failed: %w", t.name, err, prev, last)
+			}
+		}
+		out, err := op(ctx, t)
+		prev, last = t.name, err
+		return out, err
+	}
+}
+
+// dispatch executes op on the route's targets according to its action.
+func dispatch[T any](
 	ctx context.Context,
-	action config.Action,
-	op func(context.Context, store.Store, I) (T, error),
-	primaryInput, secondaryInput I,
-	s1, s2 store.Store,
+	rt route,
+	op func(context.Context, target) (T, error),
 ) (T, error) {
-	switch action {
+	op = guarded(op)
+	if rt.bodies != nil {
+		op = releasing(op, rt.bodies)
+	}
+	switch rt.action {
 	case config.ActPrimary:
-		return op(ctx, s1, primaryInput)
+		return op(ctx, rt.targets[0])
 	case config.ActSecondary:
-		return op(ctx, s2, secondaryInput)
-	case config.ActFallback:
-		return doSerial(ctx, op, primaryInput, secondaryInput, s1, s2)
+		if len(rt.targets) < 2 {
+			var zero T
+			return zero, fmt.Errorf("action %q needs at least two endpoints", rt.action)
+		}
+		return op(ctx, rt.targets[1])
+	case config.ActFallback, config.ActMigrateOnRead, config.ActMerge:
+		if rt.bodies != nil {
+			op = rewinding(op, rt.bodies)
+			// Targets after the one that succeeded never release their body.
+			for _, b := range rt.bodies {
+				defer releaseBody(b)
+			}
+		}
+		return doSerial(ctx, op, rt.targets, rt.failover)
 	case config.ActBestEffort:
-		return doParallel(ctx, false, op, primaryInput, secondaryInput, s1, s2)
+		op, err := journaled(ctx, rt, op)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		return doParallel(ctx, false, op, rt.targets)
 	case config.ActMirror:
-		return doParallel(ctx, true, op, primaryInput, secondaryInput, s1, s2)
+		if rt.rollback != nil {
+			return doMirrorRollback(ctx, rt, op)
+		}
+		return doParallel(ctx, true, op, rt.targets)
+	case config.ActQuorum:
+		return doQuorum(ctx, rt.acks, op, rt.targets)
+	case config.ActHedge:
+		return doHedge(ctx, rt.delay, op, rt.targets)
 	default:
 		// Fall back to primary if action is unknown
-		return op(ctx, s1, primaryInput)
+		return op(ctx, rt.targets[0])
 	}
 }
@@ -3,38 +3,71 @@ package s3router
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/wilbeibi/s3router/config"
+	"github.com/wilbeibi/s3router/replicate"
 	"github.com/wilbeibi/s3router/store"
 )
 
 var (
 	// raw *s3.Client implements store.Store interface directly
-	primary   store.Store = &s3.Client{}
-	secondary store.Store = &s3.Client{}
+	primary   = target{i: 0, name: config.EndpointPrimary, st: &s3.Client{}}
+	secondary = target{i: 1, name: config.EndpointSecondary, st: &s3.Client{}}
+	tertiary  = target{i: 2, name: "tertiary", st: &s3.Client{}}
 )
 
-func opString(errOn store.Store, err error) func(context.Context, store.Store, string) (string, error) {
-	return func(_ context.Context, st store.Store, _ string) (string, error) {
-		if st == errOn {
-			return "", err
-		}
-		if st == primary {
-			return "primary", nil
+func opString(errOn ...target) func(context.Context, target) (string, error) {
+	return func(_ context.Context, t target) (string, error) {
+		for _, e := range errOn {
+			if t.name == e.name {
+				return "", io.EOF
+			}
 		}
-		return "secondary", nil
+		return string(t.name), nil
 	}
 }
 
 func TestDoSerial_Fallback(t *testing.T) {
 	want := "secondary"
 	out, err := doSerial(context.Background(),
-		opString(primary, io.EOF), // primary fails, secondary succeeds
-		"", "", primary, secondary)
+		opString(primary), // primary fails, secondary succeeds
+		[]target{primary, secondary}, nil)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if out != want {
+		t.Fatalf("want %q, got %q", want, out)
+	}
+}
+
+func TestDoSerial_FallbackOrder(t *testing.T) {
+	want := "tertiary"
+	out, err := doSerial(context.Background(),
+		opString(primary, secondary),
+		[]target{secondary, primary, tertiary}, nil)
 	if err != nil {
 		t.Fatalf("got unexpected error: %v", err)
 	}
@@ -43,30 +76,55 @@ func TestDoSerial_Fallback(t *testing.T) {
 	}
 }
 
+func TestDoSerial_FailoverPolicy(t *testing.T) {
+	notFound := func(_ context.Context, t target) (string, error) {
+		if t.name == primary.name {
+			return "", &types.NoSuchKey{}
+		}
+		return string(t.name), nil
+	}
+	targets := []target{primary, secondary}
+	if out, err := doSerial(context.Background(), notFound, targets, nil); err != nil || out != "secondary" {
+		t.Fatalf("default policy: out=%q err=%v", out, err)
+	}
+	_, err := doSerial(context.Background(), notFound, targets, []config.ErrorClass{config.ErrServer})
+	if !store.IsNotFound(err) {
+		t.Fatalf("5xx-only policy: want the primary's NoSuchKey, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var calls int
+	_, err = doSerial(ctx, func(ctx context.Context, _ target) (string, error) {
+		calls++
+		return "", ctx.Err()
+	}, targets, nil)
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("after cancellation: %d calls, err %v", calls, err)
+	}
+}
+
 func TestDoParallel_MirrorStrict(t *testing.T) {
-	// secondary fails => overall error
+	// any target fails => overall error
 	_, err := doParallel(context.Background(), true,
-		opString(secondary, io.ErrUnexpectedEOF),
-		"", "", primary, secondary)
+		opString(tertiary),
+		[]target{primary, secondary, tertiary})
 	if err == nil {
-		t.Fatalf("expected error from secondary but got nil")
+		t.Fatalf("expected error from tertiary but got nil")
 	}
 }
 
 func TestDoParallel_BestEffort(t *testing.T) {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(3)
 
-	op := func(_ context.Context, cl store.Store, _ string) (string, error) {
+	op := func(_ context.Context, t target) (string, error) {
 		defer wg.Done()
-		if cl == primary {
-			return "primary", nil
-		}
-		return "secondary", nil
+		return string(t.name), nil
 	}
 
 	out, err := doParallel(context.Background(), false, /*best‑effort*/
-		op, "", "", primary, secondary)
+		op, []target{primary, secondary, tertiary})
 	if err != nil || out != "primary" {
 		t.Fatalf("unexpected result: out=%q err=%v", out, err)
 	}
@@ -74,6 +132,109 @@ func TestDoParallel_BestEffort(t *testing.T) {
 	wg.Wait()
 }
 
+func TestDoQuorum(t *testing.T) {
+	all := []target{primary, secondary, tertiary}
+	out, err := doQuorum(context.Background(), 2, opString(primary), all)
+	if err != nil || out != "secondary" {
+		t.Fatalf("unexpected result: out=%q err=%v", out, err)
+	}
+
+	_, err = doQuorum(context.Background(), 2, opString(primary, tertiary), all)
+	var qerr *QuorumError
+	if !errors.As(err, &qerr) {
+		t.Fatalf("want *QuorumError, got %v", err)
+	}
+	if qerr.Need != 2 || len(qerr.Failed) != 2 || !errors.Is(err, io.EOF) {
+		t.Fatalf("unexpected quorum error: %+v", qerr)
+	}
+}
+
+func TestDoQuorum_ReturnsWithoutStragglers(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	op := func(_ context.Context, t target) (string, error) {
+		if t.name == primary.name {
+			<-release // slow tail
+		}
+		return string(t.name), nil
+	}
+	out, err := doQuorum(context.Background(), 2, op, []target{primary, secondary, tertiary})
+	if err != nil || out != "secondary" {
+		t.Fatalf("unexpected result: out=%q err=%v", out, err)
+	}
+}
+
+func TestQuorum_FailedTargetDoesNotStallTee(t *testing.T) {
+	cfg := mustLoad(t, `
+endpoints:
+  primary: http://s3
+  secondary: http://r2
+  minio: http://minio
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": quorum
+`)
+	stores := map[config.Endpoint]store.Store{
+		config.EndpointPrimary:   newMemStore("p"),
+		config.EndpointSecondary: newMemStore("s"),
+		"minio":                  rejectStore{},
+	}
+	r, _ := NewMulti(cfg, stores)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("big.bin"),
+		Body:   bytes.NewReader(bytes.Repeat([]byte("x"), 1<<20)), // unknown length: teed
+	})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+}
+
+// rejectStore fails every PutObject without reading its body.
+type rejectStore struct{ store.Store }
+
+func (rejectStore) PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return nil, errors.New("rejected")
+}
+
+func TestDoHedge(t *testing.T) {
+	var closed sync.WaitGroup
+	closed.Add(1)
+	op := func(ctx context.Context, t target) (*s3.GetObjectOutput, error) {
+		if t.name == primary.name {
+			<-ctx.Done() // slow until the hedge wins
+			return &s3.GetObjectOutput{Body: closeFunc(closed.Done)}, nil
+		}
+		return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(string(t.name)))}, nil
+	}
+	withLat := func(t target) target {
+		t.lat = &latencies{}
+		return t
+	}
+	delay := config.HedgeDelay{Duration: time.Millisecond}
+	out, err := doHedge(context.Background(), delay, op, []target{withLat(primary), withLat(secondary)})
+	if err != nil {
+		t.Fatalf("doHedge: %v", err)
+	}
+	if b, _ := io.ReadAll(out.Body); string(b) != "secondary" {
+		t.Fatalf("served %q", b)
+	}
+	out.Body.Close()
+	closed.Wait() // the loser's body is closed
+}
+
+// closeFunc is an empty body that calls f when closed.
+type closeFunc func()
+
+func (closeFunc) Read([]byte) (int, error) { return 0, io.EOF }
+func (f closeFunc) Close() error           { f(); return nil }
+
 func TestDispatch_SelectsCorrectClient(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -89,13 +250,13 @@ func TestDispatch_SelectsCorrectClient(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			op := opString(nil, nil)
+			op := opString()
 			if tt.act == config.ActFallback {
 				// force primary error so fallback path is taken
-				op = opString(primary, io.EOF)
+				op = opString(primary)
 			}
-			out, err := dispatch(context.Background(), tt.act, op,
-				"", "", primary, secondary)
+			rt := route{action: tt.act, targets: []target{primary, secondary}}
+			out, err := dispatch(context.Background(), rt, op)
 			if err != nil {
 				t.Fatalf("dispatch error: %v", err)
 			}
@@ -106,15 +267,941 @@ func TestDispatch_SelectsCorrectClient(t *testing.T) {
 	}
 }
 
+func TestNewMulti_MirrorThreeWays(t *testing.T) {
+	cfg := mustLoad(t, `
+endpoints:
+  primary: http://s3
+  secondary: http://r2
+  minio: http://minio
+buckets:
+  photos:
+    minio: photos-onprem
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": mirror
+`)
+	stores := map[config.Endpoint]store.Store{
+		config.EndpointPrimary:   newMemStore("p"),
+		config.EndpointSecondary: newMemStore("s"),
+		"minio":                  newMemStore("m"),
+	}
+	r, err := NewMulti(cfg, stores)
+	if err != nil {
+		t.Fatalf("NewMulti: %v", err)
+	}
+	_, err = r.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String("photos"),
+		Key:           aws.String("cat.jpg"),
+		Body:          bytes.NewReader([]byte("meow")),
+		ContentLength: aws.Int64(4),
+	})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	for ep, bucket := range map[config.Endpoint]string{
+		config.EndpointPrimary:   "photos",
+		config.EndpointSecondary: "photos",
+		"minio":                  "photos-onprem",
+	} {
+		if got, _ := stores[ep].(*memStore).object(bucket, "cat.jpg"); string(got) != "meow" {
+			t.Errorf("%s: got %q", ep, got)
+		}
+	}
+
+	delete(stores, "minio")
+	if _, err := NewMulti(cfg, stores); err == nil {
+		t.Errorf("NewMulti without a store for minio: expected error")
+	}
+}
+
+func TestBestEffort_JournalsAndDrains(t *testing.T) {
+	q, err := replicate.OpenFileQueue(filepath.Join(t.TempDir(), "queue.log"))
+	if err != nil {
+		t.Fatalf("OpenFileQueue: %v", err)
+	}
+	defer q.Close()
+	cfg := mustLoad(t, `
+buckets:
+  photos:
+    secondary: cf-photos
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": best-effort
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	s.setErr(io.ErrUnexpectedEOF) // secondary outage
+	r, _ := New(cfg, p, s, WithReplicationQueue(q, replicate.WithBackoff(time.Millisecond, time.Millisecond)))
+
+	_, err = r.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("cat.jpg"),
+		Body:   bytes.NewReader([]byte("meow")),
+	})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	if d := r.QueueDepth(); d != 1 {
+		t.Fatalf("QueueDepth = %d, want 1", d)
+	}
+
+	// let the secondary's own attempt fail before the outage ends
+	for {
+		s.mu.Lock()
+		n := s.puts
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.setErr(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if got, _ := s.object("cf-photos", "cat.jpg"); string(got) != "meow" {
+		t.Fatalf("secondary not repaired: %q", got)
+	}
+	if d := r.QueueDepth(); d != 0 {
+		t.Fatalf("QueueDepth after Drain = %d, want 0", d)
+	}
+}
+
+// tagOutage fails PutObjectTagging while down is set.
+type tagOutage struct {
+	*memStore
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+func (o *tagOutage) PutObjectTagging(ctx context.Context, in *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	defer o.calls.Add(1)
+	if o.down.Load() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return o.memStore.PutObjectTagging(ctx, in, optFns...)
+}
+
+func TestBestEffort_ReplaysOnlyTags(t *testing.T) {
+	q, err := replicate.OpenFileQueue(filepath.Join(t.TempDir(), "queue.log"))
+	if err != nil {
+		t.Fatalf("OpenFileQueue: %v", err)
+	}
+	defer q.Close()
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": best-effort
+`)
+	p, s := newMemStore("p"), &tagOutage{memStore: newMemStore("s")}
+	p.objects["photos/cat.jpg"], s.objects["photos/cat.jpg"] = []byte("new"), []byte("old")
+	s.down.Store(true)
+	r, _ := New(cfg, p, s, WithReplicationQueue(q, replicate.WithBackoff(time.Hour, time.Hour)))
+
+	_, err = r.PutObjectTagging(context.Background(), &s3.PutObjectTaggingInput{
+		Bucket:  aws.String("photos"),
+		Key:     aws.String("cat.jpg"),
+		Tagging: &types.Tagging{TagSet: []types.Tag{{Key: aws.String("tier"), Value: aws.String("cold")}}},
+	})
+	if err != nil {
+		t.Fatalf("PutObjectTagging: %v", err)
+	}
+	// let the secondary's own attempt fail before the outage ends
+	for s.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.down.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	s.mu.Lock()
+	tags := len(s.tags["photos/cat.jpg"])
+	s.mu.Unlock()
+	if tags != 1 {
+		t.Errorf("secondary has %d tags, want 1", tags)
+	}
+	if got, _ := s.object("photos", "cat.jpg"); string(got) != "old" {
+		t.Errorf("replay copied the object: secondary has %q", got)
+	}
+}
+
+func TestBestEffort_HealthySecondaryGetsBody(t *testing.T) {
+	q, err := replicate.OpenFileQueue(filepath.Join(t.TempDir(), "queue.log"))
+	if err != nil {
+		t.Fatalf("OpenFileQueue: %v", err)
+	}
+	defer q.Close()
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": best-effort
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	r, _ := New(cfg, p, s, WithReplicationQueue(q, replicate.WithBackoff(time.Hour, time.Hour)))
+
+	// buffered, then teed
+	for key, size := range map[string]*int64{"cat.jpg": aws.Int64(4), "dog.jpg": nil} {
+		_, err = r.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket:        aws.String("photos"),
+			Key:           aws.String(key),
+			Body:          bytes.NewReader([]byte("meow")),
+			ContentLength: size,
+		})
+		if err != nil {
+			t.Fatalf("PutObject: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.QueueDepth() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("secondary write was not acknowledged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, key := range []string{"cat.jpg", "dog.jpg"} {
+		if got, _ := s.object("photos", key); string(got) != "meow" {
+			t.Fatalf("secondary got %q for %s", got, key)
+		}
+	}
+}
+
+func TestGetObject_MigrateOnRead(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        GetObject:
+          migrate-on-read: [secondary, primary]
+        "*": secondary
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	p.objects["photos/cat.jpg"] = []byte("meow")
+	r, _ := New(cfg, p, s)
+
+	out, err := r.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String("photos"), Key: aws.String("cat.jpg"),
+	})
+	if err != nil {
+		t.Fatalf("GetObject: %v", err)
+	}
+	if b, _ := io.ReadAll(out.Body); string(b) != "meow" {
+		t.Fatalf("served %q", b)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, ok := s.object("photos", "cat.jpg"); ok {
+			if string(got) != "meow" {
+				t.Fatalf("migrated %q", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("object was not migrated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFallback_ReadRepair(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        GetObject:
+          fallback:
+          repair: copy
+        HeadObject:
+          fallback:
+          repair: report
+        "*": primary
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	s.objects["photos/cat.jpg"] = []byte("meow")
+	found := make(chan Divergence, 2)
+	r, _ := New(cfg, p, s, WithReadRepairReport(func(_ context.Context, d Divergence) { found <- d }))
+	ctx := context.Background()
+
+	if _, err := r.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.jpg")}); err != nil {
+		t.Fatalf("HeadObject: %v", err)
+	}
+	want := Divergence{Bucket: "photos", Key: "cat.jpg", Missing: config.EndpointPrimary, Found: config.EndpointSecondary}
+	if d := <-found; d != want {
+		t.Fatalf("reported %+v, want %+v", d, want)
+	}
+	if _, ok := p.object("photos", "cat.jpg"); ok {
+		t.Fatalf("report mode copied the object")
+	}
+
+	out, err := r.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.jpg")})
+	if err != nil {
+		t.Fatalf("GetObject: %v", err)
+	}
+	out.Body.Close()
+	want.Copied = true
+	if d := <-found; d != want {
+		t.Fatalf("reported %+v, want %+v", d, want)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, ok := p.object("photos", "cat.jpg"); ok {
+			if string(got) != "meow" {
+				t.Fatalf("repaired %q", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("object was not repaired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readErrStore fails GetObject with err, when set, and counts the calls.
+type readErrStore struct {
+	*memStore
+	err   func() error
+	reads atomic.Int32
+}
+
+func (s *readErrStore) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	s.reads.Add(1)
+	if s.err != nil {
+		if err := s.err(); err != nil {
+			return nil, err
+		}
+	}
+	return s.memStore.GetObject(ctx, in, optFns...)
+}
+
+func TestFallback_ReadRepairStopsLikeFallback(t *testing.T) {
+	const yml = `
+endpoints:
+  primary: http://s3
+  secondary: http://r2
+  minio: http://minio
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        GetObject:
+          fallback:
+          repair: copy
+          failover: [%s]
+        "*": primary
+`
+	serverErr := &smithy.GenericAPIError{Code: "InternalError", Fault: smithy.FaultServer}
+	for _, tc := range []struct {
+		name     string
+		failover string
+		cancel   bool
+	}{
+		{"error outside the failover classes", "not-found", false},
+		{"caller cancelled", "not-found, 5xx, network", true},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		p := &readErrStore{memStore: newMemStore("p")}
+		s := &readErrStore{memStore: newMemStore("s"), err: func() error {
+			if tc.cancel {
+				cancel()
+				return ctx.Err()
+			}
+			return serverErr
+		}}
+		m := &readErrStore{memStore: newMemStore("m")}
+		m.objects["photos/cat.jpg"] = []byte("meow")
+		var reports atomic.Int32
+		r, _ := NewMulti(mustLoad(t, fmt.Sprintf(yml, tc.failover)), map[config.Endpoint]store.Store{
+			config.EndpointPrimary: p, config.EndpointSecondary: s, "minio": m,
+		}, WithReadRepairReport(func(context.Context, Divergence) { reports.Add(1) }))
+
+		_, err := r.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.jpg")})
+		if err == nil {
+			t.Errorf("%s: GetObject succeeded, want the secondary's error", tc.name)
+		}
+		if n := m.reads.Load(); n != 0 {
+			t.Errorf("%s: read the third endpoint %d times after the secondary failed", tc.name, n)
+		}
+		if n := reports.Load(); n != 0 {
+			t.Errorf("%s: reported %d divergences", tc.name, n)
+		}
+		cancel()
+	}
+}
+
+func TestFallback_ReadRepairIgnoresMissingBucket(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        GetObject:
+          fallback:
+          repair: copy
+        "*": primary
+`)
+	noBucket := &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotFound}},
+		Err:      &types.NoSuchBucket{},
+	}}
+	p := &readErrStore{memStore: newMemStore("p"), err: func() error { return noBucket }}
+	s := newMemStore("s")
+	s.objects["photos/cat.jpg"] = []byte("meow")
+	var reports atomic.Int32
+	r, _ := New(cfg, p, s, WithReadRepairReport(func(context.Context, Divergence) { reports.Add(1) }))
+
+	out, err := r.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.jpg")})
+	if err != nil {
+		t.Fatalf("GetObject: %v", err)
+	}
+	out.Body.Close()
+	if n := reports.Load(); n != 0 {
+		t.Errorf("reported %d divergences for a missing bucket", n)
+	}
+	if _, busy := r.(*router).migrating.Load("primary/photos/cat.jpg"); busy {
+		t.Errorf("started a repair copy into a missing bucket")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := p.object("photos", "cat.jpg"); ok {
+		t.Errorf("copied the object into a missing bucket")
+	}
+}
+
+func TestObjectTagging(t *testing.T) {
+	ctx := context.Background()
+	p, s := newMemStore("p"), newMemStore("s")
+	p.objects["photos/m/x"], s.objects["cf-photos/m/x"] = []byte("x"), []byte("x")
+	r, _ := New(mustLoad(t, splitYAML), p, s)
+	tags := func(st *memStore, bucket string) string {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		var out []string
+		for _, tag := range st.tags[bucket+"/m/x"] {
+			out = append(out, aws.ToString(tag.Key)+"="+aws.ToString(tag.Value))
+		}
+		return fmt.Sprint(out)
+	}
+
+	// mirrored
+	_, err := r.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket: aws.String("photos"), Key: aws.String("m/x"),
+		Tagging: &types.Tagging{TagSet: []types.Tag{{Key: aws.String("tier"), Value: aws.String("cold")}}},
+	})
+	if err != nil {
+		t.Fatalf("PutObjectTagging: %v", err)
+	}
+	if got, got2 := tags(p, "photos"), tags(s, "cf-photos"); got != "[tier=cold]" || got2 != got {
+		t.Fatalf("tags = %s, %s", got, got2)
+	}
+	out, err := r.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String("photos"), Key: aws.String("m/x")})
+	if err != nil || len(out.TagSet) != 1 {
+		t.Fatalf("GetObjectTagging = %v, %v", out, err)
+	}
+
+	// copied across endpoints with the object
+	p.objects["photos/a/x"] = []byte("x")
+	p.setTags("photos", "a/x", []types.Tag{{Key: aws.String("tier"), Value: aws.String("hot")}})
+	_, err = r.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket: aws.String("photos"), Key: aws.String("b/x"), CopySource: aws.String("photos/a/x"),
+	})
+	if err != nil {
+		t.Fatalf("CopyObject: %v", err)
+	}
+	s.mu.Lock()
+	copied := len(s.tags["cf-photos/b/x"])
+	s.mu.Unlock()
+	if copied != 1 {
+		t.Fatalf("copy has %d tags, want 1", copied)
+	}
+
+	if _, err := r.DeleteObjectTagging(ctx, &s3.DeleteObjectTaggingInput{Bucket: aws.String("photos"), Key: aws.String("m/x")}); err != nil {
+		t.Fatalf("DeleteObjectTagging: %v", err)
+	}
+	if got, got2 := tags(p, "photos"), tags(s, "cf-photos"); got != "[]" || got2 != "[]" {
+		t.Fatalf("tags after delete = %s, %s", got, got2)
+	}
+}
+
+func TestListObjectsV2_Merge(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        ListObjectsV2:
+          merge:
+          prefer: secondary
+        "*": secondary
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	for _, k := range []string{"a", "c", "d", "f"} {
+		p.objects["photos/"+k] = []byte("p")
+	}
+	for _, k := range []string{"b", "c", "e"} {
+		s.objects["photos/"+k] = []byte("ss")
+	}
+	r, _ := New(cfg, p, s)
+
+	var keys []string
+	var sizes []int64
+	in := &s3.ListObjectsV2Input{Bucket: aws.String("photos"), MaxKeys: aws.Int32(2)}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("listing did not terminate: %v", keys)
+		}
+		out, err := r.ListObjectsV2(context.Background(), in)
+		if err != nil {
+			t.Fatalf("ListObjectsV2: %v", err)
+		}
+		for _, o := range out.Contents {
+			keys = append(keys, aws.ToString(o.Key))
+			sizes = append(sizes, aws.ToInt64(o.Size))
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		in.ContinuationToken = out.NextContinuationToken
+	}
+	if got := fmt.Sprint(keys); got != "[a b c d e f]" {
+		t.Fatalf("keys = %s", got)
+	}
+	if sizes[2] != 2 {
+		t.Fatalf("c served from primary, want the preferred secondary")
+	}
+}
+
+func TestDeleteObjects_SplitsByRule(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "raw/":
+        "*": mirror
+      "processed/":
+        "*": secondary
+      "*":
+        "*": primary
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	for _, k := range []string{"raw/a", "processed/b", "c"} {
+		p.objects["photos/"+k] = []byte("p")
+		s.objects["photos/"+k] = []byte("s")
+	}
+	r, _ := New(cfg, p, s)
+
+	out, err := r.DeleteObjects(context.Background(), &s3.DeleteObjectsInput{
+		Bucket: aws.String("photos"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{
+			{Key: aws.String("raw/a")}, {Key: aws.String("processed/b")}, {Key: aws.String("c")},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("DeleteObjects: %v", err)
+	}
+	if len(out.Deleted) != 3 || len(out.Errors) != 0 {
+		t.Fatalf("Deleted = %d, Errors = %d", len(out.Deleted), len(out.Errors))
+	}
+	for _, tc := range []struct {
+		m    *memStore
+		key  string
+		want bool
+	}{
+		{p, "raw/a", false}, {s, "raw/a", false},
+		{p, "processed/b", true}, {s, "processed/b", false},
+		{p, "c", false}, {s, "c", true},
+	} {
+		if _, ok := tc.m.object("photos", tc.key); ok != tc.want {
+			t.Errorf("%s: %s present = %v, want %v", tc.m.name, tc.key, ok, tc.want)
+		}
+	}
+	del := &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("raw/a")}, {Key: aws.String("c")}}}
+	if _, err := r.DeleteObjects(context.Background(), &s3.DeleteObjectsInput{
+		Bucket: aws.String("videos"), Delete: del,
+	}); err == nil {
+		t.Errorf("DeleteObjects on an unconfigured bucket: expected error")
+	}
+	p.setErr(io.ErrUnexpectedEOF)
+	s.setErr(io.ErrUnexpectedEOF)
+	if _, err := r.DeleteObjects(context.Background(), &s3.DeleteObjectsInput{
+		Bucket: aws.String("photos"), Delete: del,
+	}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DeleteObjects with every batch failing: err = %v", err)
+	}
+}
+
+func TestListObjectsV2_StitchesPrefixes(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "raw/":
+        "*": mirror
+      "processed/":
+        "*": secondary
+      "*":
+        "*": primary
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	for _, k := range []string{"a", "processed/stale1", "processed/stale2", "processed/stale3", "raw/1", "raw/2/x", "z"} {
+		p.objects["photos/"+k] = []byte("p")
+	}
+	for _, k := range []string{"b", "processed/1", "processed/2/x"} {
+		s.objects["photos/"+k] = []byte("s")
+	}
+	r, _ := New(cfg, p, s)
+
+	list := func(prefix, delim string, maxKeys int32) []string {
+		t.Helper()
+		var got []string
+		in := &s3.ListObjectsV2Input{Bucket: aws.String("photos"), MaxKeys: aws.Int32(maxKeys)}
+		if prefix != "" {
+			in.Prefix = aws.String(prefix)
+		}
+		if delim != "" {
+			in.Delimiter = aws.String(delim)
+		}
+		for pages := 0; ; pages++ {
+			if pages > 20 {
+				t.Fatalf("listing did not terminate: %v", got)
+			}
+			out, err := r.ListObjectsV2(context.Background(), in)
+			if err != nil {
+				t.Fatalf("ListObjectsV2: %v", err)
+			}
+			for _, o := range out.Contents {
+				got = append(got, aws.ToString(o.Key))
+			}
+			for _, cp := range out.CommonPrefixes {
+				got = append(got, aws.ToString(cp.Prefix))
+			}
+			if !aws.ToBool(out.IsTruncated) {
+				return got
+			}
+			in.ContinuationToken = out.NextContinuationToken
+		}
+	}
+	for _, tc := range []struct {
+		prefix, delim string
+		maxKeys       int32
+		want          string
+	}{
+		{"", "", 1000, "[a processed/1 processed/2/x raw/1 raw/2/x z]"},
+		{"", "", 1, "[a processed/1 processed/2/x raw/1 raw/2/x z]"},
+		{"", "/", 1000, "[a z processed/ raw/]"},
+		{"", "/", 1, "[a processed/ raw/ z]"},
+		{"processed/", "/", 1000, "[processed/1 processed/2/]"},
+	} {
+		if got := fmt.Sprint(list(tc.prefix, tc.delim, tc.maxKeys)); got != tc.want {
+			t.Errorf("list(%q, %q, %d) = %s, want %s", tc.prefix, tc.delim, tc.maxKeys, got, tc.want)
+		}
+	}
+}
+
+func TestCircuitBreaker_FallbackSkipsOpenEndpoint(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": fallback
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	p.setErr(io.ErrUnexpectedEOF)
+	var (
+		mu          sync.Mutex
+		transitions []string
+	)
+	r, _ := New(cfg, p, s, WithCircuitBreaker(BreakerConfig{
+		Window: 4, MinRequests: 2, Cooldown: 20 * time.Millisecond,
+		OnStateChange: func(ep config.Endpoint, from, to BreakerState) {
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, fmt.Sprintf("%s:%s->%s", ep, from, to))
+		},
+	}))
+	put := func() {
+		t.Helper()
+		_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String("cat.jpg"), Body: bytes.NewReader([]byte("meow")),
+		})
+		if err != nil {
+			t.Fatalf("PutObject: %v", err)
+		}
+	}
+	puts := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.puts
+	}
+
+	put()
+	put()
+	if got := r.BreakerStates()[config.EndpointPrimary]; got != BreakerOpen {
+		t.Fatalf("primary breaker = %s, want open", got)
+	}
+	put()
+	if n := puts(); n != 2 {
+		t.Fatalf("primary called %d times, want 2 with its breaker open", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	p.setErr(nil)
+	put() // probe
+	if n := puts(); n != 3 {
+		t.Fatalf("primary called %d times, want a probe", n)
+	}
+	if got := r.BreakerStates()[config.EndpointPrimary]; got != BreakerClosed {
+		t.Fatalf("primary breaker = %s, want closed", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := "[primary:closed->open primary:open->half-open primary:half-open->closed]"
+	if got := fmt.Sprint(transitions); got != want {
+		t.Fatalf("transitions = %s, want %s", got, want)
+	}
+}
+
+func TestCircuitBreaker_IgnoresClientErrors(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": primary
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	r, _ := New(cfg, p, s, WithCircuitBreaker(BreakerConfig{Window: 4, MinRequests: 2}))
+	put := func() error {
+		_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String("cat.jpg"), Body: bytes.NewReader([]byte("meow")),
+		})
+		return err
+	}
+	for _, err := range []error{
+		&smithy.GenericAPIError{Code: "PreconditionFailed", Fault: smithy.FaultClient},
+		&smithy.GenericAPIError{Code: "AccessDenied", Fault: smithy.FaultClient},
+		&types.NoSuchUpload{},
+		&types.NoSuchKey{},
+	} {
+		p.setErr(err)
+		for range 4 {
+			_ = put()
+		}
+		if got := r.BreakerStates()[config.EndpointPrimary]; got != BreakerClosed {
+			t.Fatalf("after %T errors, primary breaker = %s, want closed", err, got)
+		}
+	}
+	p.setErr(nil)
+	if err := put(); err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+}
+
+func TestBreaker_OnlyProbeDecidesHalfOpen(t *testing.T) {
+	b := &breaker{cfg: BreakerConfig{Window: 2, MinRequests: 2, ErrorRate: 0.5, Cooldown: 20 * time.Millisecond}, window: make([]bool, 2)}
+	_, slowProbe := b.allow() // admitted while closed, returns late
+	for range 2 {
+		_, probe := b.allow()
+		b.record(probe, true)
+	}
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("breaker = %s, want open", got)
+	}
+	time.Sleep(30 * time.Millisecond)
+	ok, probe := b.allow()
+	if !ok || !probe {
+		t.Fatalf("allow after cool-down = %v, %v, want a probe", ok, probe)
+	}
+	b.record(slowProbe, false)
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Fatalf("a request admitted while closed moved the breaker to %s", got)
+	}
+	b.record(probe, true)
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("failed probe left the breaker %s, want open", got)
+	}
+}
+
+func TestFallback_ReplaysBody(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": fallback
+`)
+	want := []byte("meow")
+	for _, tc := range []struct {
+		name string
+		body io.Reader
+		size *int64
+		err  error
+	}{
+		{"seekable", bytes.NewReader(want), nil, nil},
+		{"buffered", struct{ io.Reader }{bytes.NewReader(want)}, aws.Int64(int64(len(want))), nil},
+		{"unknown size", struct{ io.Reader }{bytes.NewReader(want)}, nil, ErrBodyNotReplayable},
+	} {
+		p, s := newMemStore("p"), newMemStore("s")
+		p.setErr(io.ErrUnexpectedEOF)
+		r, _ := New(cfg, p, s)
+		_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String("cat.jpg"), Body: tc.body, ContentLength: tc.size,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%s: want %v, got %v", tc.name, tc.err, err)
+		}
+		got, ok := s.object("photos", "cat.jpg")
+		if tc.err == nil && !bytes.Equal(got, want) {
+			t.Errorf("%s: secondary got %q", tc.name, got)
+		}
+		if tc.err != nil && ok {
+			t.Errorf("%s: secondary got a truncated body %q", tc.name, got)
+		}
+		if n := r.BufferedBytes(); n != 0 {
+			t.Errorf("%s: %d bytes still buffered", tc.name, n)
+		}
+	}
+}
+
+// crcStore returns the CRC32C of what it stored, which is corrupted when
+// flip is set.
+type crcStore struct {
+	*memStore
+	flip bool
+}
+
+func (c crcStore) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	if c.flip {
+		data[0] ^= 1
+	}
+	in.Body = bytes.NewReader(data)
+	out, err := c.memStore.PutObject(ctx, in, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	sum := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	out.ChecksumCRC32C = aws.String(base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, sum)))
+	return out, nil
+}
+
+func TestMirror_VerifiesChecksums(t *testing.T) {
+	yaml := `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*":
+          mirror:
+          verify: %s
+`
+	for _, tc := range []struct {
+		verify string
+		flip   bool
+		fail   bool
+	}{{"fail", false, false}, {"fail", true, true}, {"flag", true, false}} {
+		var flagged []*ChecksumError
+		p, s := newMemStore("p"), newMemStore("s")
+		r, _ := New(mustLoad(t, fmt.Sprintf(yaml, tc.verify)), crcStore{memStore: p}, crcStore{memStore: s, flip: tc.flip},
+			WithChecksumMismatch(func(_ context.Context, e *ChecksumError) { flagged = append(flagged, e) }))
+		_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String("cat.jpg"), Body: struct{ io.Reader }{strings.NewReader("meow")},
+		})
+		var cerr *ChecksumError
+		if got := errors.As(err, &cerr); got != tc.fail {
+			t.Fatalf("verify %s, flip %v: err = %v", tc.verify, tc.flip, err)
+		}
+		if (len(flagged) == 1) != tc.flip {
+			t.Fatalf("verify %s, flip %v: flagged %v", tc.verify, tc.flip, flagged)
+		}
+		if tc.flip && flagged[0].Got[config.EndpointSecondary] == flagged[0].Want {
+			t.Fatalf("secondary checksum %s matches the body", flagged[0].Want)
+		}
+	}
+}
+
+func TestMirrorRollback(t *testing.T) {
+	cfg := mustLoad(t, `
+buckets:
+  photos: {}
+rules:
+  - bucket: photos
+    prefix:
+      "*":
+        "*": mirror
+`)
+	p, s := newMemStore("p"), newMemStore("s")
+	s.setErr(io.ErrUnexpectedEOF)
+	r, _ := New(cfg, p, s, WithMirrorRollback())
+
+	_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String("photos"),
+		Key:           aws.String("cat.jpg"),
+		Body:          bytes.NewReader([]byte("meow")),
+		ContentLength: aws.Int64(4),
+	})
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want *RollbackError wrapping the secondary's error, got %v", err)
+	}
+	if !rerr.Compensated() || fmt.Sprint(rerr.RolledBack) != "[primary]" {
+		t.Fatalf("unexpected rollback: %+v", rerr)
+	}
+	if _, ok := p.object("photos", "cat.jpg"); ok {
+		t.Fatalf("primary copy was not rolled back")
+	}
+}
+
 func TestDrainBody(t *testing.T) {
 	ctx := context.Background()
 	want := []byte("hello‑world")
-	r1, r2, err := drainBody(ctx, bytes.NewReader(want))
+	rs, err := drainBody(ctx, bytes.NewReader(want), 2)
 	if err != nil {
 		t.Fatalf("drainBody error: %v", err)
 	}
-	b1, _ := io.ReadAll(r1)
-	b2, _ := io.ReadAll(r2)
+	b1, _ := io.ReadAll(rs[0])
+	b2, _ := io.ReadAll(rs[1])
 	if !bytes.Equal(b1, want) || !bytes.Equal(b2, want) {
 		t.Fatalf("data mismatch; got %q / %q", b1, b2)
 	}
@@ -124,7 +1211,7 @@ func TestTeeBody(t *testing.T) {
 	ctx := context.Background()
 	want := []byte("stream‑content")
 
-	pr1, pr2, err := teeBody(ctx, bytes.NewReader(want))
+	rs, err := teeBody(ctx, bytes.NewReader(want), 2, defaultTee)
 	if err != nil {
 		t.Fatalf("teeBody error: %v", err)
 	}
@@ -133,11 +1220,589 @@ func TestTeeBody(t *testing.T) {
 	wg.Add(2)
 
 	var b1, b2 []byte
-	go func() { b1, _ = io.ReadAll(pr1); wg.Done() }()
-	go func() { b2, _ = io.ReadAll(pr2); wg.Done() }()
+	go func() { b1, _ = io.ReadAll(rs[0]); wg.Done() }()
+	go func() { b2, _ = io.ReadAll(rs[1]); wg.Done() }()
 	wg.Wait()
 
 	if !bytes.Equal(b1, want) || !bytes.Equal(b2, want) {
 		t.Fatalf("data mismatch; got %q / %q", b1, b2)
 	}
 }
+
+func TestTeeBody_FailsStalledSide(t *testing.T) {
+	want := bytes.Repeat([]byte("x"), 1<<16)
+	rs, _ := teeBody(context.Background(), bytes.NewReader(want), 2, teeConfig{size: 1 << 10, stall: 20 * time.Millisecond})
+
+	// rs[1] is never read until rs[0] is done
+	got, err := io.ReadAll(rs[0])
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("reader 0: %d bytes, %v", len(got), err)
+	}
+	if _, err := io.ReadAll(rs[1]); !errors.Is(err, ErrBodyStalled) {
+		t.Fatalf("reader 1: want ErrBodyStalled, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	rs, _ = teeBody(ctx, pr, 1, defaultTee)
+	go func() {
+		pw.Write([]byte("x"))
+		cancel()
+		pw.Write([]byte("y"))
+	}()
+	if _, err := io.ReadAll(rs[0]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+}
+
+func TestBestEffortTee(t *testing.T) {
+	want := bytes.Repeat([]byte("x"), 64<<10)
+	rs := (&router{}).bestEffortTee(bytes.NewReader(want), 3, 128<<10)
+
+	// the lead never waits: it reads everything before anyone else starts
+	if b, _ := io.ReadAll(rs[0]); !bytes.Equal(b, want) {
+		t.Fatalf("lead got %d bytes", len(b))
+	}
+	if b, err := io.ReadAll(rs[1]); err != nil || !bytes.Equal(b, want) {
+		t.Fatalf("side got %d bytes, err %v", len(b), err)
+	}
+
+	rs = (&router{}).bestEffortTee(bytes.NewReader(want), 2, 16<<10)
+	if b, _ := io.ReadAll(rs[0]); !bytes.Equal(b, want) {
+		t.Fatalf("lead got %d bytes", len(b))
+	}
+	if _, err := io.ReadAll(rs[1]); !errors.Is(err, errBodyNotCopied) {
+		t.Fatalf("lagging side: want errBodyNotCopied, got %v", err)
+	}
+}
+
+func TestSpillToDisk(t *testing.T) {
+	cfg := mustLoad(t, mirrorYAML)
+	dir := t.TempDir()
+	p, s := newMemStore("p"), newMemStore("s")
+	r, _ := New(cfg, p, s, WithSpillToDisk(dir, 16, 1<<20))
+	sp := r.(*router).spool
+
+	want := bytes.Repeat([]byte("spool"), 1000)
+	_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("photos"), Key: aws.String("big.bin"), Body: bytes.NewReader(want),
+	})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	for _, tc := range []struct {
+		st     *memStore
+		bucket string
+	}{{p, "photos"}, {s, "cf-photos"}} {
+		if got, _ := tc.st.object(tc.bucket, "big.bin"); !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes", tc.st.name, len(got))
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 || sp.used != 0 {
+		t.Fatalf("spool not cleaned up: %d files, %d bytes reserved", len(files), sp.used)
+	}
+
+	// an unknown-size body over budget fails, and leaves nothing behind
+	_, err = r.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("photos"), Key: aws.String("huge.bin"), Body: bytes.NewReader(make([]byte, 3<<20)),
+	})
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("want ErrSpoolFull, got %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 || sp.used != 0 {
+		t.Fatalf("spool not cleaned up: %d files, %d bytes reserved", len(files), sp.used)
+	}
+}
+
+func TestBufferBudget(t *testing.T) {
+	cfg := mustLoad(t, mirrorYAML)
+	body := bytes.Repeat([]byte("x"), 100)
+	put := func(r Router, key string) error {
+		_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String(key),
+			Body: bytes.NewReader(body), ContentLength: aws.Int64(int64(len(body))),
+		})
+		return err
+	}
+
+	for _, tc := range []struct {
+		policy BudgetPolicy
+		want   error
+	}{{BudgetWait, nil}, {BudgetStream, nil}, {BudgetReject, ErrBufferBudget}} {
+		p, s := newMemStore("p"), newMemStore("s")
+		r, _ := New(cfg, p, s, WithBufferBudget(150, tc.policy))
+		b := r.(*router).budget
+
+		// another request holds most of the budget
+		ok, _ := b.acquire(context.Background(), 100)
+		if !ok {
+			t.Fatalf("policy %d: could not reserve", tc.policy)
+		}
+		var err error
+		if tc.policy == BudgetWait {
+			done := make(chan error, 1)
+			go func() { done <- put(r, "a.jpg") }()
+			select {
+			case err := <-done:
+				t.Fatalf("policy %d: did not wait for the budget: %v", tc.policy, err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			b.release(100)
+			err = <-done
+		} else {
+			err = put(r, "a.jpg")
+			b.release(100)
+		}
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("policy %d: want %v, got %v", tc.policy, tc.want, err)
+		}
+		if tc.want == nil {
+			if got, _ := s.object("cf-photos", "a.jpg"); !bytes.Equal(got, body) {
+				t.Errorf("policy %d: secondary got %d bytes", tc.policy, len(got))
+			}
+		}
+		if n := r.BufferedBytes(); n != 0 || b.used != 0 {
+			t.Fatalf("policy %d: %d bytes still buffered, %d reserved", tc.policy, n, b.used)
+		}
+	}
+}
+
+// sampleStore records the most body memory the router held while the
+// bodies of its writes were being read.
+type sampleStore struct {
+	*memStore
+	router Router
+	peak   atomic.Int64
+	body   atomic.Value // type of the last body sent
+}
+
+func (s *sampleStore) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	s.body.Store(fmt.Sprintf("%T", in.Body))
+	in.Body = &sampleReader{r: in.Body, s: s}
+	return s.memStore.PutObject(ctx, in, optFns...)
+}
+
+type sampleReader struct {
+	r io.Reader
+	s *sampleStore
+}
+
+func (r *sampleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for {
+		held, peak := r.s.router.BufferedBytes(), r.s.peak.Load()
+		if held <= peak || r.s.peak.CompareAndSwap(peak, held) {
+			break
+		}
+	}
+	return n, err
+}
+
+func TestBufferBudget_CoversSpoolAndBestEffort(t *testing.T) {
+	const limit = 1 << 10
+	big := bytes.Repeat([]byte("x"), 4<<20)
+	for _, tc := range []struct {
+		name   string
+		action string
+		opts   []Option
+		body   []byte
+		size   *int64
+	}{
+		{"spooled in memory", "mirror", []Option{WithSpillToDisk(t.TempDir(), 8<<20, 64<<20)}, big[:100], aws.Int64(100)},
+		{"spooled to disk", "mirror", []Option{WithSpillToDisk(t.TempDir(), 8<<20, 64<<20)}, big, nil},
+		{"best-effort tee", "best-effort", nil, big, nil},
+	} {
+		p := &sampleStore{memStore: newMemStore("p")}
+		s := &sampleStore{memStore: newMemStore("s")}
+		cfg := mustLoad(t, strings.Replace(mirrorYAML, "mirror", tc.action, 1))
+		r, _ := New(cfg, p, s, append(tc.opts, WithBufferBudget(limit, BudgetReject))...)
+		p.router, s.router = r, r
+
+		_, err := r.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("photos"), Key: aws.String("a.bin"),
+			Body: struct{ io.Reader }{bytes.NewReader(tc.body)}, ContentLength: tc.size,
+		})
+		if err != nil {
+			t.Fatalf("%s: PutObject: %v", tc.name, err)
+		}
+		if got, _ := p.object("photos", "a.bin"); !bytes.Equal(got, tc.body) {
+			t.Errorf("%s: primary got %d bytes, want %d", tc.name, len(got), len(tc.body))
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for r.BufferedBytes() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %d bytes still buffered", tc.name, r.BufferedBytes())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if peak := max(p.peak.Load(), s.peak.Load()); peak > limit {
+			t.Errorf("%s: held %d bytes, over the %d byte budget", tc.name, peak, limit)
+		}
+		switch tc.name {
+		case "spooled in memory":
+			if p.peak.Load() == 0 {
+				t.Errorf("%s: body was not counted against the budget", tc.name)
+			}
+		case "spooled to disk":
+			if got := p.body.Load(); got != "*s3router.spoolReader" {
+				t.Errorf("%s: primary was sent a %v", tc.name, got)
+			}
+		case "best-effort tee":
+			if _, ok := s.object("cf-photos", "a.bin"); ok {
+				t.Errorf("%s: secondary was given the body beyond the budget", tc.name)
+			}
+		}
+	}
+}
+
+// memStore is an in-memory store.Store for tests. Operations it does not
+// implement panic through the nil embedded interface.
+type memStore struct {
+	store.Store
+	name string
+
+	mu      sync.Mutex
+	err     error                       // returned by writes when set
+	puts    int                         // PutObject calls, failed or not
+	copies  int                         // server-side CopyObject calls
+	buckets map[string]bool             // created with CreateBucket
+	tags    map[string][]types.Tag      // bucket/key -> tags
+	objects map[string][]byte           // bucket/key -> body
+	uploads map[string]map[int32][]byte // upload ID -> part number -> body
+	opened  map[string]memUpload        // upload ID -> where it was opened
+}
+
+// memUpload is an upload in progress on a memStore.
+type memUpload struct {
+	bucket string
+	types.MultipartUpload
+}
+
+func (m *memStore) setErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+func newMemStore(name string) *memStore {
+	return &memStore{
+		name:    name,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int32][]byte),
+		opened:  make(map[string]memUpload),
+	}
+}
+
+func (m *memStore) object(bucket, key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[bucket+"/"+key]
+	return b, ok
+}
+
+func (m *memStore) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.puts++
+	if m.err != nil {
+		return nil, m.err
+	}
+	if _, ok := m.objects[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)]; ok && aws.ToString(in.IfNoneMatch) == "*" {
+		return nil, errors.New("PreconditionFailed")
+	}
+	m.objects[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)] = data
+	if in.Tagging != nil {
+		v, _ := url.ParseQuery(*in.Tagging)
+		var tags []types.Tag
+		for k := range v {
+			tags = append(tags, types.Tag{Key: aws.String(k), Value: aws.String(v.Get(k))})
+		}
+		m.setTags(aws.ToString(in.Bucket), aws.ToString(in.Key), tags)
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(m.name)}, nil
+}
+
+// setTags must be called with m.mu held.
+func (m *memStore) setTags(bucket, key string, tags []types.Tag) {
+	if m.tags == nil {
+		m.tags = make(map[string][]types.Tag)
+	}
+	m.tags[bucket+"/"+key] = tags
+}
+
+func (m *memStore) GetObjectTagging(_ context.Context, in *s3.GetObjectTaggingInput, _ ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	if _, ok := m.object(aws.ToString(in.Bucket), aws.ToString(in.Key)); !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &s3.GetObjectTaggingOutput{TagSet: m.tags[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)]}, nil
+}
+
+func (m *memStore) PutObjectTagging(_ context.Context, in *s3.PutObjectTaggingInput, _ ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if _, ok := m.object(aws.ToString(in.Bucket), aws.ToString(in.Key)); !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setTags(aws.ToString(in.Bucket), aws.ToString(in.Key), in.Tagging.TagSet)
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (m *memStore) DeleteObjectTagging(_ context.Context, in *s3.DeleteObjectTaggingInput, _ ...func(*s3.Options)) (*s3.DeleteObjectTaggingOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tags, aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key))
+	return &s3.DeleteObjectTaggingOutput{}, nil
+}
+
+func (m *memStore) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := m.object(aws.ToString(in.Bucket), aws.ToString(in.Key))
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	if rng := aws.ToString(in.Range); rng != "" {
+		var from, to int
+		fmt.Sscanf(rng, "bytes=%d-%d", &from, &to)
+		data = data[from : to+1]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+	}, nil
+}
+
+func (m *memStore) CopyObject(_ context.Context, in *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	bucket, key, _, err := parseCopySource(aws.ToString(in.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	data, ok := m.object(bucket, key)
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copies++
+	m.objects[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)] = data
+	return &s3.CopyObjectOutput{CopyObjectResult: &types.CopyObjectResult{ETag: aws.String(m.name)}}, nil
+}
+
+func (m *memStore) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	data, ok := m.object(aws.ToString(in.Bucket), aws.ToString(in.Key))
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (m *memStore) CreateBucket(_ context.Context, in *s3.CreateBucketInput, _ ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets == nil {
+		m.buckets = make(map[string]bool)
+	}
+	m.buckets[aws.ToString(in.Bucket)] = true
+	return &s3.CreateBucketOutput{Location: aws.String("/" + aws.ToString(in.Bucket))}, nil
+}
+
+func (m *memStore) HeadBucket(_ context.Context, in *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.buckets[aws.ToString(in.Bucket)] {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *memStore) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := fmt.Sprintf("%s-%d", m.name, len(m.opened))
+	m.uploads[id] = make(map[int32][]byte)
+	m.opened[id] = memUpload{aws.ToString(in.Bucket), types.MultipartUpload{
+		Key: in.Key, UploadId: aws.String(id), Initiated: aws.Time(time.Now()),
+	}}
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+func (m *memStore) UploadPart(_ context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts, ok := m.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	parts[aws.ToInt32(in.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("%s-%d", m.name, aws.ToInt32(in.PartNumber)))}, nil
+}
+
+func (m *memStore) UploadPartCopy(ctx context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	bucket, key, _, err := parseCopySource(aws.ToString(in.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	obj, err := m.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key), Range: in.CopySourceRange})
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.copies++
+	m.mu.Unlock()
+	out, err := m.UploadPart(ctx, &s3.UploadPartInput{UploadId: in.UploadId, PartNumber: in.PartNumber, Body: obj.Body})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: out.ETag}}, nil
+}
+
+func (m *memStore) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts, ok := m.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	var data []byte
+	for _, p := range in.MultipartUpload.Parts {
+		n := aws.ToInt32(p.PartNumber)
+		if aws.ToString(p.ETag) != fmt.Sprintf("%s-%d", m.name, n) {
+			return nil, fmt.Errorf("%s: bad ETag %q for part %d", m.name, aws.ToString(p.ETag), n)
+		}
+		data = append(data, parts[n]...)
+	}
+	delete(m.uploads, aws.ToString(in.UploadId))
+	delete(m.opened, aws.ToString(in.UploadId))
+	m.objects[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)] = data
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(m.name)}, nil
+}
+
+func (m *memStore) AbortMultipartUpload(_ context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, aws.ToString(in.UploadId))
+	delete(m.opened, aws.ToString(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// ListMultipartUploads lists uploads by key and then upload ID, ignoring
+// delimiters.
+func (m *memStore) ListMultipartUploads(_ context.Context, in *s3.ListMultipartUploadsInput, _ ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ups []types.MultipartUpload
+	for _, u := range m.opened {
+		if u.bucket == aws.ToString(in.Bucket) && strings.HasPrefix(aws.ToString(u.Key), aws.ToString(in.Prefix)) {
+			ups = append(ups, u.MultipartUpload)
+		}
+	}
+	sort.Slice(ups, func(i, j int) bool {
+		ki, kj := aws.ToString(ups[i].Key), aws.ToString(ups[j].Key)
+		return ki < kj || ki == kj && aws.ToString(ups[i].UploadId) < aws.ToString(ups[j].UploadId)
+	})
+	km, idm := aws.ToString(in.KeyMarker), aws.ToString(in.UploadIdMarker)
+	start := sort.Search(len(ups), func(i int) bool {
+		k := aws.ToString(ups[i].Key)
+		return k > km || k == km && idm != "" && aws.ToString(ups[i].UploadId) > idm
+	})
+	ups = ups[start:]
+	out := &s3.ListMultipartUploadsOutput{Bucket: in.Bucket, IsTruncated: aws.Bool(false)}
+	if n := int(aws.ToInt32(in.MaxUploads)); n > 0 && n < len(ups) {
+		ups = ups[:n]
+		out.IsTruncated = aws.Bool(true)
+		out.NextKeyMarker, out.NextUploadIdMarker = ups[n-1].Key, ups[n-1].UploadId
+	}
+	out.Uploads = ups
+	return out, nil
+}
+
+func (m *memStore) DeleteObject(_ context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	delete(m.objects, aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *memStore) DeleteObjects(_ context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	out := &s3.DeleteObjectsOutput{}
+	for _, obj := range in.Delete.Objects {
+		delete(m.objects, aws.ToString(in.Bucket)+"/"+aws.ToString(obj.Key))
+		out.Deleted = append(out.Deleted, types.DeletedObject{Key: obj.Key})
+	}
+	return out, nil
+}
+
+// ListObjectsV2 pages through a bucket's keys; continuation tokens are the
+// last key or common prefix returned.
+func (m *memStore) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	after := aws.ToString(in.StartAfter)
+	if in.ContinuationToken != nil {
+		after = *in.ContinuationToken
+	}
+	prefix, delim := aws.ToString(in.Prefix), aws.ToString(in.Delimiter)
+	var keys []string
+	for k := range m.objects {
+		bucket, key, _ := strings.Cut(k, "/")
+		if bucket == aws.ToString(in.Bucket) && key > after && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{Name: in.Bucket, IsTruncated: aws.Bool(false)}
+	var n int32
+	for _, k := range keys {
+		if delim != "" {
+			if i := strings.Index(k[len(prefix):], delim); i >= 0 {
+				cp := k[:len(prefix)+i+len(delim)]
+				if l := len(out.CommonPrefixes); l > 0 && aws.ToString(out.CommonPrefixes[l-1].Prefix) == cp {
+					continue
+				}
+				if cp <= after {
+					continue
+				}
+				if n == aws.ToInt32(in.MaxKeys) {
+					out.IsTruncated = aws.Bool(true)
+					break
+				}
+				out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(cp)})
+				out.NextContinuationToken = aws.String(cp + string(utf8.MaxRune))
+				n++
+				continue
+			}
+		}
+		if n == aws.ToInt32(in.MaxKeys) {
+			out.IsTruncated = aws.Bool(true)
+			break
+		}
+		out.Contents = append(out.Contents, types.Object{
+			Key:  aws.String(k),
+			Size: aws.Int64(int64(len(m.objects[aws.ToString(in.Bucket)+"/"+k]))),
+		})
+		out.NextContinuationToken = aws.String(k)
+		n++
+	}
+	if !aws.ToBool(out.IsTruncated) {
+		out.NextContinuationToken = nil
+	}
+	out.KeyCount = aws.Int32(n)
+	return out, nil
+}
@@ -0,0 +1,186 @@
+package s3router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSpoolFull is returned when a body of unknown size outgrows the disk
+// budget set with WithSpillToDisk.
+var ErrSpoolFull = errors.New("spool disk budget exhausted")
+
+// WithSpillToDisk buffers mirrored and quorum bodies instead of teeing them,
+// so each endpoint reads at its own pace and can seek back to retry. Bodies
+// up to memBytes are kept in memory; larger ones are spooled to a temporary
+// file in dir ("" for os.TempDir), removed once every endpoint is done with
+// it. Spool files of all requests together stay within diskBytes: a body
+// of known size that does not fit is teed instead, and one of unknown size
+// that outgrows it fails with ErrSpoolFull. Bodies kept in memory count
+// against WithBufferBudget.
+func WithSpillToDisk(dir string, memBytes, diskBytes int64) Option {
+	return func(c *router) {
+		c.spool = &spooler{dir: dir, memBytes: memBytes, diskBytes: diskBytes, mem: c}
+	}
+}
+
+// spooler splits bodies through memory or temporary files.
+type spooler struct {
+	dir       string
+	memBytes  int64
+	diskBytes int64
+	mem       *router // accounts for bodies kept in memory
+
+	mu   sync.Mutex
+	used int64 // bytes reserved by spool files
+}
+
+func (s *spooler) reserve(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used+n > s.diskBytes {
+		return false
+	}
+	s.used += n
+	return true
+}
+
+func (s *spooler) unreserve(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+}
+
+// split returns n independent readers over body. Bodies that may fit in
+// memBytes are read into memory first, if the buffer budget allows. A body
+// of known size that does not fit the disk budget is handed, unread past
+// the memory part, to overflow instead.
+func (s *spooler) split(
+	ctx context.Context,
+	body io.Reader,
+	size *int64,
+	n int,
+	overflow func(io.Reader) ([]io.Reader, error),
+) ([]io.Reader, error) {
+	var mem bytes.Buffer
+	if size == nil || *size <= s.memBytes {
+		limit := s.memBytes + 1
+		if size != nil {
+			limit = *size + 1
+		}
+		held, err := s.mem.hold(ctx, limit)
+		if errors.Is(err, ErrBufferBudget) {
+			held, err = false, nil // spool it to disk instead
+		}
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			if _, err := io.CopyN(&mem, body, limit); err == io.EOF {
+				s.mem.unhold(limit - int64(mem.Len()))
+				readers := make([]io.Reader, n)
+				for i := range readers {
+					readers[i] = bytes.NewReader(mem.Bytes())
+				}
+				return s.mem.held(readers, int64(mem.Len())), nil
+			} else if err != nil {
+				s.mem.unhold(limit)
+				return nil, err
+			}
+			// The memory part is only held until it is on disk.
+			defer s.mem.unhold(limit)
+		}
+	}
+
+	var reserved int64
+	if size != nil {
+		if !s.reserve(*size) {
+			// Nothing but the memory part has been read.
+			return overflow(io.MultiReader(&mem, body))
+		}
+		reserved = *size
+	}
+	f, err := os.CreateTemp(s.dir, "s3router-spool-*")
+	if err != nil {
+		s.unreserve(reserved)
+		return nil, err
+	}
+	fail := func(err error) ([]io.Reader, error) {
+		f.Close()
+		os.Remove(f.Name())
+		s.unreserve(reserved)
+		return nil, err
+	}
+	written, err := mem.WriteTo(f)
+	if err != nil {
+		return fail(err)
+	}
+	buf := make([]byte, 1<<20)
+	for {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		m, rerr := body.Read(buf)
+		if m > 0 {
+			if written+int64(m) > reserved {
+				grow := max(written+int64(m)-reserved, int64(len(buf)))
+				if !s.reserve(grow) {
+					return fail(fmt.Errorf("%w: body exceeds %d bytes", ErrSpoolFull, s.diskBytes))
+				}
+				reserved += grow
+			}
+			if _, err := f.Write(buf[:m]); err != nil {
+				return fail(err)
+			}
+			written += int64(m)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return fail(rerr)
+		}
+	}
+	if reserved > written {
+		s.unreserve(reserved - written)
+		reserved = written
+	}
+
+	sf := &spoolFile{f: f, size: written, s: s}
+	sf.refs.Store(int32(n))
+	readers := make([]io.Reader, n)
+	for i := range readers {
+		readers[i] = &spoolReader{SectionReader: io.NewSectionReader(f, 0, written), file: sf}
+	}
+	return readers, nil
+}
+
+// spoolFile is a spooled body shared by the readers of every target.
+type spoolFile struct {
+	f    *os.File
+	size int64
+	s    *spooler
+	refs atomic.Int32
+}
+
+func (sf *spoolFile) release() {
+	if sf.refs.Add(-1) == 0 {
+		sf.f.Close()
+		os.Remove(sf.f.Name())
+		sf.s.unreserve(sf.size)
+	}
+}
+
+// spoolReader is one target's view of a spoolFile.
+type spoolReader struct {
+	*io.SectionReader
+	file *spoolFile
+	once sync.Once
+}
+
+func (r *spoolReader) release() { r.once.Do(r.file.release) }
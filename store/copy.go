@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CopyObject streams key from srcBucket on src to dstBucket on dst,
+// keeping its content headers, user metadata and tags. opts adjust the
+// PutObject request sent to dst.
+func CopyObject(ctx context.Context, src Store, srcBucket string, dst Store, dstBucket, key string, opts ...func(*s3.PutObjectInput)) error {
+	obj, err := src.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	in := &s3.PutObjectInput{
+		Bucket:             aws.String(dstBucket),
+		Key:                aws.String(key),
+		Body:               obj.Body,
+		ContentLength:      obj.ContentLength,
+		ContentType:        obj.ContentType,
+		ContentEncoding:    obj.ContentEncoding,
+		ContentDisposition: obj.ContentDisposition,
+		ContentLanguage:    obj.ContentLanguage,
+		CacheControl:       obj.CacheControl,
+		Expires:            obj.Expires,
+		Metadata:           obj.Metadata,
+	}
+	if aws.ToInt32(obj.TagCount) > 0 {
+		if in.Tagging, err = Tagging(ctx, src, srcBucket, key, nil); err != nil {
+			return err
+		}
+	}
+	for _, opt := range opts {
+		opt(in)
+	}
+	_, err = dst.PutObject(ctx, in)
+	return err
+}
+
+// Tagging returns the tags of key in bucket on st, encoded as for the
+// Tagging field of PutObjectInput, or nil if it has none.
+func Tagging(ctx context.Context, st Store, bucket, key string, versionID *string, optFns ...func(*s3.Options)) (*string, error) {
+	tags, err := st.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(key),
+		VersionId: versionID,
+	}, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags.TagSet) == 0 {
+		return nil, nil
+	}
+	v := url.Values{}
+	for _, t := range tags.TagSet {
+		v.Set(aws.ToString(t.Key), aws.ToString(t.Value))
+	}
+	return aws.String(v.Encode()), nil
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/wilbeibi/s3router/config"
+)
+
+// IsNotFound reports whether err means the requested object does not exist.
+func IsNotFound(err error) bool {
+	var (
+		nsk *types.NoSuchKey
+		nf  *types.NotFound
+		re  *awshttp.ResponseError
+		ae  smithy.APIError
+	)
+	switch {
+	case errors.As(err, &nsk), errors.As(err, &nf):
+		return true
+	case errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound:
+		return true
+	case errors.As(err, &ae):
+		return ae.ErrorCode() == "NoSuchKey" || ae.ErrorCode() == "NotFound"
+	}
+	return false
+}
+
+// IsNoSuchKey reports whether err means the object itself does not exist,
+// rather than its bucket or the requested version.
+func IsNoSuchKey(err error) bool {
+	var (
+		nsk *types.NoSuchKey
+		ae  smithy.APIError
+	)
+	switch {
+	case errors.As(err, &nsk):
+		return true
+	case errors.As(err, &ae):
+		return ae.ErrorCode() == "NoSuchKey" || ae.ErrorCode() == "NotFound"
+	}
+	return false
+}
+
+// throttlingCodes are the error codes S3 and compatible stores use to ask
+// the caller to slow down.
+var throttlingCodes = map[string]bool{
+	"SlowDown":                 true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestLimitExceeded":     true,
+	"TooManyRequests":          true,
+	"TooManyRequestsException": true,
+}
+
+// Classify sorts err into the error classes a failover policy names. Errors
+// without an HTTP status or API error code are network errors.
+func Classify(err error) config.ErrorClass {
+	var (
+		ne net.Error
+		re *awshttp.ResponseError
+		ae smithy.APIError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return config.ErrCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return config.ErrTimeout
+	case IsNotFound(err):
+		return config.ErrNotFound
+	case errors.As(err, &ae) && throttlingCodes[ae.ErrorCode()]:
+		return config.ErrThrottling
+	}
+	if errors.As(err, &re) {
+		switch code := re.HTTPStatusCode(); {
+		case code == http.StatusTooManyRequests:
+			return config.ErrThrottling
+		case code >= 500:
+			return config.ErrServer
+		case code >= 400:
+			return config.ErrClient
+		}
+	}
+	if errors.As(err, &ae) {
+		if ae.ErrorFault() == smithy.FaultServer {
+			return config.ErrServer
+		}
+		return config.ErrClient
+	}
+	return config.ErrNetwork
+}
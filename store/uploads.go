@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrUploadNotFound is returned by an UploadStore when no mapping exists for
+// an upload ID.
+var ErrUploadNotFound = errors.New("upload mapping not found")
+
+// Upload records the state of a multipart upload on the endpoints other than
+// the one whose upload ID was returned to the caller.
+type Upload struct {
+	UploadIDs map[string]string           // endpoint -> upload ID
+	ETags     map[string]map[int32]string // endpoint -> part number -> ETag
+}
+
+// UploadStore maps the upload ID returned to the caller to the upload IDs and
+// part ETags on the other endpoints. Implementations must be safe for
+// concurrent use; share one between processes to route a multipart upload
+// through more than one router instance.
+type UploadStore interface {
+	Put(ctx context.Context, uploadID string, u *Upload) error
+	Get(ctx context.Context, uploadID string) (*Upload, error)
+	PutPart(ctx context.Context, uploadID, endpoint string, part int32, etag string) error
+	Delete(ctx context.Context, uploadID string) error
+}
+
+// MemoryUploadStore is an in-process UploadStore.
+type MemoryUploadStore struct {
+	mu      sync.Mutex
+	uploads map[string]*Upload
+}
+
+var _ UploadStore = (*MemoryUploadStore)(nil)
+
+func NewMemoryUploadStore() *MemoryUploadStore {
+	return &MemoryUploadStore{uploads: make(map[string]*Upload)}
+}
+
+func (m *MemoryUploadStore) Put(_ context.Context, uploadID string, u *Upload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[uploadID] = u.clone()
+	return nil
+}
+
+func (m *MemoryUploadStore) Get(_ context.Context, uploadID string) (*Upload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[uploadID]
+	if !ok {
+		return nil, ErrUploadNotFound
+	}
+	return u.clone(), nil
+}
+
+func (m *MemoryUploadStore) PutPart(_ context.Context, uploadID, endpoint string, part int32, etag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[uploadID]
+	if !ok {
+		return ErrUploadNotFound
+	}
+	if u.ETags == nil {
+		u.ETags = make(map[string]map[int32]string)
+	}
+	if u.ETags[endpoint] == nil {
+		u.ETags[endpoint] = make(map[int32]string)
+	}
+	u.ETags[endpoint][part] = etag
+	return nil
+}
+
+func (m *MemoryUploadStore) Delete(_ context.Context, uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+func (u *Upload) clone() *Upload {
+	c := &Upload{
+		UploadIDs: make(map[string]string, len(u.UploadIDs)),
+		ETags:     make(map[string]map[int32]string, len(u.ETags)),
+	}
+	for ep, id := range u.UploadIDs {
+		c.UploadIDs[ep] = id
+	}
+	for ep, parts := range u.ETags {
+		c.ETags[ep] = make(map[int32]string, len(parts))
+		for n, etag := range parts {
+			c.ETags[ep][n] = etag
+		}
+	}
+	return c
+}